@@ -0,0 +1,32 @@
+package main
+
+import "strings"
+
+// defaultAgent is the buildkite-agent binary used unless agent_path is set
+const defaultAgent = "buildkite-agent"
+
+// annotate adds or replaces the annotation identified by context
+// on the current build.
+func annotate(agent string, body string, style string, context string) error {
+	_, err := executeCommand(
+		agent,
+		[]string{"annotate", body, "--style", style, "--context", context},
+	)
+
+	return err
+}
+
+// setMetaData sets the build meta-data key to value.
+func setMetaData(agent string, key string, value string) error {
+	_, err := executeCommand(agent, []string{"meta-data", "set", key, value})
+
+	return err
+}
+
+// getMetaData returns the value of the build meta-data key,
+// or an empty string if it is not set.
+func getMetaData(agent string, key string) (string, error) {
+	output, err := executeCommand(agent, []string{"meta-data", "get", key, "--default", ""})
+
+	return strings.TrimSpace(output), err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/buildkite/bintest"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockBuildkiteAgent puts a mock buildkite-agent binary first on the PATH
+// for the duration of the test.
+func mockBuildkiteAgent(t *testing.T) *bintest.Mock {
+	agent, err := bintest.NewMock("buildkite-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	t.Cleanup(func() { os.Setenv("PATH", oldPath) })
+	os.Setenv("PATH", filepath.Dir(agent.Path)+":"+oldPath)
+
+	return agent
+}
+
+func TestAnnotate(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("annotate", "some body", "--style", "warning", "--context", "some-context").
+		AndExitWith(0)
+
+	err := annotate(defaultAgent, "some body", "warning", "some-context")
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestAnnotateFails(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("annotate", "some body", "--style", "error", "--context", "some-context").
+		AndExitWith(1)
+
+	err := annotate(defaultAgent, "some body", "error", "some-context")
+	assert.Error(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestSetMetaData(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("meta-data", "set", "some-key", "some\nvalue").
+		AndExitWith(0)
+
+	err := setMetaData(defaultAgent, "some-key", "some\nvalue")
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Environment variables exposing the change set to the generated steps
+const (
+	changedFilesEnv    = "MONOREPO_DIFF_CHANGED_FILES"
+	changedFilesKeyEnv = "MONOREPO_DIFF_CHANGED_FILES_META_DATA_KEY"
+	matchedPathsEnv    = "MONOREPO_DIFF_MATCHED_PATHS"
+	baseCommitEnv      = "MONOREPO_DIFF_BASE_COMMIT"
+	headCommitEnv      = "MONOREPO_DIFF_HEAD_COMMIT"
+	buildIDEnv         = "MONOREPO_DIFF_BUILD_ID"
+)
+
+// Build meta-data keys describing the change set
+const (
+	changedFilesKey = "monorepo-diff:changed-files"
+	triggeredKey    = "monorepo-diff:triggered"
+	baseCommitKey   = "monorepo-diff:base-commit"
+	headCommitKey   = "monorepo-diff:head-commit"
+)
+
+// metaDataKey returns the meta-data key for the plugin instance, which
+// names the instance when there are several, so that their keys differ.
+func metaDataKey(plugin Plugin, key string) string {
+	if plugin.Instance == "" {
+		return key
+	}
+
+	return pluginName + ":" + plugin.Instance + strings.TrimPrefix(key, pluginName)
+}
+
+// maxEnvListSize is the size in bytes above which a list of changed files
+// is written to build meta-data instead of the step env.
+const maxEnvListSize = 4096
+
+// changeSet is what the diff found, as exposed to the generated steps
+type changeSet struct {
+	Files      []string
+	BaseCommit string
+	HeadCommit string
+}
+
+func newChangeSet(plugin Plugin, files []string) changeSet {
+	return changeSet{
+		Files:      files,
+		BaseCommit: resolveCommit(baseRef(plugin)),
+		HeadCommit: resolveCommit(env("BUILDKITE_COMMIT", "HEAD")),
+	}
+}
+
+// baseRef returns the ref the diff is computed against, if it is known.
+func baseRef(plugin Plugin) string {
+	if plugin.BaseCommit != "" {
+		return plugin.BaseCommit
+	}
+
+	if plugin.Diff == defaultDiff {
+		return "HEAD~1"
+	}
+
+	return ""
+}
+
+// resolveCommit turns ref into a commit hash, falling back to ref itself
+// if git cannot resolve it.
+func resolveCommit(ref string) string {
+	if ref == "" {
+		return ""
+	}
+
+	output, err := executeCommand("git", []string{"rev-parse", "--verify", "--quiet", ref + "^{commit}"})
+	if err != nil {
+		log.Debugf("could not resolve commit %s: %v", ref, err)
+		return ref
+	}
+
+	return strings.TrimSpace(output)
+}
+
+// withChangesEnv returns a copy of watch where every step has the
+// change set that concerns it added to its env.
+func withChangesEnv(plugin Plugin, watch []WatchConfig, changes changeSet) ([]WatchConfig, error) {
+	result := make([]WatchConfig, len(watch))
+
+	for i, w := range watch {
+		vars := map[string]string{}
+
+		if changes.BaseCommit != "" {
+			vars[baseCommitEnv] = changes.BaseCommit
+		}
+
+		if changes.HeadCommit != "" {
+			vars[headCommitEnv] = changes.HeadCommit
+		}
+
+		key := metaDataKey(plugin, fmt.Sprintf("%s:%d", changedFilesKey, i))
+		files, paths := changes.Files, []string{}
+
+		if w.Default == nil {
+			var err error
+
+			key, files, paths, err = stepChanges(plugin, watch, i, changes.Files)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		vars[matchedPathsEnv] = strings.Join(paths, " ")
+
+		if list := strings.Join(files, " "); len(list) <= maxEnvListSize {
+			vars[changedFilesEnv] = list
+		} else {
+			if plugin.DryRun {
+				log.Debugf("not writing %d changed files to meta-data key %s on a dry run", len(files), key)
+			} else {
+				log.Debugf("writing %d changed files to meta-data key %s", len(files), key)
+
+				if err := setMetaData(plugin.agent(), key, strings.Join(files, "\n")); err != nil {
+					return nil, fmt.Errorf("could not write changed files to meta-data: %v", err)
+				}
+			}
+
+			vars[changedFilesKeyEnv] = key
+			vars[buildIDEnv] = env("BUILDKITE_BUILD_ID", "")
+		}
+
+		if plugin.Interpolation {
+			for k, v := range vars {
+				vars[k] = escapeInterpolation(v)
+			}
+		}
+
+		w.Step = withEnv(w.Step, vars)
+		result[i] = w
+	}
+
+	return result, nil
+}
+
+// stepChanges returns the files and paths matched by the watch entry at
+// index i. Entries sharing the same step are merged so that their steps
+// are still deduplicated, and share the meta-data key of the first one.
+func stepChanges(plugin Plugin, watch []WatchConfig, i int, files []string) (string, []string, []string, error) {
+	key := ""
+	matched, paths := []string{}, []string{}
+
+	for j, w := range watch {
+		if w.Default != nil || !reflect.DeepEqual(w.Step, watch[i].Step) {
+			continue
+		}
+
+		if key == "" {
+			key = metaDataKey(plugin, fmt.Sprintf("%s:%d", changedFilesKey, j))
+		}
+
+		for _, f := range files {
+			p, match, err := matchingPath(w, f)
+			if err != nil {
+				return "", nil, nil, err
+			}
+
+			if match {
+				matched = appendUnique(matched, f)
+				paths = appendUnique(paths, p)
+			}
+		}
+	}
+
+	return key, matched, paths, nil
+}
+
+func appendUnique(list []string, value string) []string {
+	for _, v := range list {
+		if v == value {
+			return list
+		}
+	}
+
+	return append(list, value)
+}
+
+// writeMetaData records the change set and the names of the triggered
+// steps in the build meta-data, one value per line. Empty values are
+// not written.
+func writeMetaData(plugin Plugin, changes changeSet, steps []Step) error {
+	triggered := []string{}
+	for _, s := range steps {
+		if name := stepName(s); name != "" {
+			triggered = append(triggered, name)
+		}
+	}
+
+	metaData := []struct {
+		key   string
+		value string
+	}{
+		{changedFilesKey, strings.Join(changes.Files, "\n")},
+		{triggeredKey, strings.Join(triggered, "\n")},
+		{baseCommitKey, changes.BaseCommit},
+		{headCommitKey, changes.HeadCommit},
+	}
+
+	for _, m := range metaData {
+		if m.value == "" {
+			continue
+		}
+
+		key := metaDataKey(plugin, m.key)
+		log.Debugf("setting meta-data %s", key)
+
+		if err := setMetaData(plugin.agent(), key, m.value); err != nil {
+			return fmt.Errorf("could not set meta-data %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
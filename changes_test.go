@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/bintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBaseRef(t *testing.T) {
+	assert.Equal(t, "HEAD~1", baseRef(Plugin{Diff: defaultDiff}))
+	assert.Equal(t, "main", baseRef(Plugin{Diff: defaultDiff, BaseCommit: "main"}))
+	assert.Equal(t, "", baseRef(Plugin{Diff: "./diff.sh"}))
+}
+
+func TestPluginBaseCommitDrivesTheDefaultDiff(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff#v1.2.0": {"base_commit": "origin/main"}}]`)
+	require.NoError(t, err)
+	assert.Equal(t, "git diff --name-only 'origin/main'", got.Diff)
+	assert.Equal(t, "origin/main", baseRef(got))
+
+	got, err = initializePlugin(`[{"monorepo-diff#v1.2.0": {"base_commit": "it's", "diff": "./diff.sh"}}]`)
+	require.NoError(t, err)
+	assert.Equal(t, "./diff.sh", got.Diff)
+}
+
+func TestResolveCommit(t *testing.T) {
+	assert.Len(t, resolveCommit("HEAD"), 40)
+	assert.Equal(t, "not-a-ref", resolveCommit("not-a-ref"))
+	assert.Equal(t, "", resolveCommit(""))
+}
+
+func TestWithChangesEnv(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			Paths: []string{"service-1/"},
+			Step:  Step{Command: "echo service-1"},
+		},
+		{
+			Paths: []string{"lib/"},
+			Step:  Step{Command: "echo service-1"},
+		},
+		{
+			Paths: []string{"service-2/"},
+			Step:  Step{Trigger: "service-2"},
+		},
+		{
+			Default: true,
+			Step:    Step{Command: "echo default"},
+		},
+	}
+
+	changes := changeSet{
+		Files:      []string{"service-1/main.go", "lib/$util.go", "README.md"},
+		BaseCommit: "abc",
+		HeadCommit: "def",
+	}
+
+	got, err := withChangesEnv(Plugin{Interpolation: true}, watch, changes)
+	require.NoError(t, err)
+
+	service1 := map[string]string{
+		changedFilesEnv: "service-1/main.go lib/$$util.go",
+		matchedPathsEnv: "service-1/ lib/",
+		baseCommitEnv:   "abc",
+		headCommitEnv:   "def",
+	}
+
+	assert.Equal(t, service1, got[0].Step.Env)
+	assert.Equal(t, service1, got[1].Step.Env)
+	assert.Equal(t, map[string]string{
+		changedFilesEnv: "",
+		matchedPathsEnv: "",
+		baseCommitEnv:   "abc",
+		headCommitEnv:   "def",
+	}, got[2].Step.Build.Env)
+	assert.Equal(t, map[string]string{
+		changedFilesEnv: "service-1/main.go lib/$$util.go README.md",
+		matchedPathsEnv: "",
+		baseCommitEnv:   "abc",
+		headCommitEnv:   "def",
+	}, got[3].Step.Env)
+
+	steps, err := stepsToTrigger(changes.Files, got)
+	require.NoError(t, err)
+	assert.Len(t, steps, 1)
+
+	assert.Nil(t, watch[0].Step.Env)
+}
+
+func TestWithChangesEnvWritesLargeListsToMetaData(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_ID", "build-id")
+
+	files := []string{}
+	for i := 0; len(strings.Join(files, " ")) <= maxEnvListSize; i++ {
+		files = append(files, fmt.Sprintf("service-1/file-%d.go", i))
+	}
+
+	watch := []WatchConfig{
+		{
+			Paths: []string{"service-1/"},
+			Step:  Step{Trigger: "service-1"},
+		},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "set", "monorepo-diff:changed-files:0", strings.Join(files, "\n")).
+		AndExitWith(0)
+
+	got, err := withChangesEnv(Plugin{}, watch, changeSet{Files: files})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{
+		changedFilesKeyEnv: "monorepo-diff:changed-files:0",
+		buildIDEnv:         "build-id",
+		matchedPathsEnv:    "service-1/",
+	}, got[0].Step.Build.Env)
+
+	agent.CheckAndClose(t)
+}
+
+func TestMetaDataKey(t *testing.T) {
+	assert.Equal(t, "monorepo-diff:changed-files", metaDataKey(Plugin{}, changedFilesKey))
+	assert.Equal(t, "monorepo-diff:docs:changed-files:0", metaDataKey(Plugin{Instance: "docs"}, changedFilesKey+":0"))
+	assert.Equal(t, "monorepo-diff:1:triggered", metaDataKey(Plugin{Instance: "1"}, triggeredKey))
+}
+
+func TestWithChangesEnvNamesTheInstance(t *testing.T) {
+	t.Setenv("BUILDKITE_BUILD_ID", "build-id")
+
+	files := []string{strings.Repeat("a", maxEnvListSize+1)}
+	watch := []WatchConfig{{Paths: []string{"a"}, Step: Step{Trigger: "service-1"}}}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "set", "monorepo-diff:1:changed-files:0", bintest.MatchAny()).
+		AndExitWith(0)
+
+	got, err := withChangesEnv(Plugin{Instance: "1"}, watch, changeSet{Files: files})
+	require.NoError(t, err)
+	assert.Equal(t, "monorepo-diff:1:changed-files:0", got[0].Step.Build.Env[changedFilesKeyEnv])
+
+	agent.CheckAndClose(t)
+}
+
+func TestWithChangesEnvWritesNoMetaDataOnDryRun(t *testing.T) {
+	files := []string{strings.Repeat("a", maxEnvListSize+1)}
+	watch := []WatchConfig{{Paths: []string{"a"}, Step: Step{Trigger: "service-1"}}}
+
+	agent := mockBuildkiteAgent(t)
+
+	got, err := withChangesEnv(Plugin{DryRun: true}, watch, changeSet{Files: files})
+	require.NoError(t, err)
+	assert.Equal(t, "monorepo-diff:changed-files:0", got[0].Step.Build.Env[changedFilesKeyEnv])
+
+	agent.CheckAndClose(t)
+}
+
+func TestWithChangesEnvFailsIfMetaDataCannotBeWritten(t *testing.T) {
+	files := []string{strings.Repeat("a", maxEnvListSize+1)}
+
+	watch := []WatchConfig{
+		{
+			Paths: []string{"a"},
+			Step:  Step{Trigger: "service-1"},
+		},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "set", "monorepo-diff:changed-files:0", bintest.MatchAny()).
+		AndExitWith(1)
+
+	_, err := withChangesEnv(Plugin{}, watch, changeSet{Files: files})
+	assert.Error(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestWriteMetaData(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("meta-data", "set", changedFilesKey, "service-1/main.go\nREADME.md").
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", triggeredKey, "service-1\nrun tests").
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", headCommitKey, "def").
+		AndExitWith(0)
+
+	changes := changeSet{
+		Files:      []string{"service-1/main.go", "README.md"},
+		HeadCommit: "def",
+	}
+
+	steps := []Step{
+		{Trigger: "service-1"},
+		{Label: "run tests", Command: "make test"},
+	}
+
+	err := writeMetaData(Plugin{}, changes, steps)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestWriteMetaDataFails(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("meta-data", "set", changedFilesKey, "README.md").
+		AndExitWith(1)
+
+	err := writeMetaData(Plugin{}, changeSet{Files: []string{"README.md"}}, []Step{})
+	assert.EqualError(t, err, "could not set meta-data monorepo-diff:changed-files: command `buildkite-agent` failed: exit status 1")
+
+	agent.CheckAndClose(t)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// validatePatterns checks the syntax of branch or tag patterns.
+// Matching a pattern against itself surfaces its syntax errors.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "!")
+		if _, err := doublestar.Match(pattern, pattern); err != nil {
+			return fmt.Errorf("invalid pattern %s", pattern)
+		}
+	}
+
+	return nil
+}
+
+// matchPatterns tells whether name matches the patterns: it must match at
+// least one of them, and none of those starting with `!`.
+func matchPatterns(patterns []string, name string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+
+		match, _ := doublestar.Match(strings.TrimPrefix(pattern, "!"), name)
+		if !match {
+			continue
+		}
+
+		if negated {
+			return false
+		}
+		matched = true
+	}
+
+	return matched
+}
+
+// excludedBy returns why the watch entry does not apply to the branch or
+// tag being built, or an empty string if it applies. An entry with both
+// branches and tags applies when either matches.
+func excludedBy(w WatchConfig, branch string, tag string) string {
+	if len(w.Branches) == 0 && len(w.Tags) == 0 {
+		return ""
+	}
+
+	if len(w.Branches) > 0 && branch != "" && matchPatterns(w.Branches, branch) {
+		return ""
+	}
+
+	if len(w.Tags) > 0 && tag != "" && matchPatterns(w.Tags, tag) {
+		return ""
+	}
+
+	reasons := []string{}
+	if len(w.Branches) > 0 {
+		reasons = append(reasons, fmt.Sprintf("branch %q does not match %s", branch, strings.Join(w.Branches, ", ")))
+	}
+	if len(w.Tags) > 0 {
+		reasons = append(reasons, fmt.Sprintf("tag %q does not match %s", tag, strings.Join(w.Tags, ", ")))
+	}
+
+	return strings.Join(reasons, " and ")
+}
+
+// withMatchingRef returns the watch entries that apply to the branch
+// or tag being built.
+func withMatchingRef(watch []WatchConfig) []WatchConfig {
+	branch := env("BUILDKITE_BRANCH", "")
+	tag := env("BUILDKITE_TAG", "")
+
+	result := []WatchConfig{}
+
+	for _, w := range watch {
+		if reason := excludedBy(w, branch, tag); reason != "" {
+			log.Infof("Excluding watch entry %s: %s", watchName(w), reason)
+			continue
+		}
+		result = append(result, w)
+	}
+
+	return result
+}
+
+// watchName describes a watch entry in logs.
+func watchName(w WatchConfig) string {
+	if w.ID != "" {
+		return w.ID
+	}
+
+	if name := stepName(w.Step); name != "" {
+		return name
+	}
+
+	return strings.Join(w.Paths, ", ")
+}
+
+// withMatchingCondition returns the watch entries whose `when` expression
+// holds for the changed files.
+func withMatchingCondition(watch []WatchConfig, files []string) ([]WatchConfig, error) {
+	result := []WatchConfig{}
+
+	for _, w := range watch {
+		if w.When == "" {
+			result = append(result, w)
+			continue
+		}
+
+		matched := []string{}
+		for _, f := range files {
+			match, err := matchWatch(w, f)
+			if err != nil {
+				return nil, err
+			}
+
+			if match {
+				matched = append(matched, f)
+			}
+		}
+
+		condition := w.Condition
+		if condition == nil {
+			parsed, err := parseExpression(w.When)
+			if err != nil {
+				return nil, fmt.Errorf("watch entry %s: when: %v", watchName(w), err)
+			}
+			condition = parsed
+		}
+
+		holds, err := evalCondition(condition, exprContext{Files: files, Matched: matched})
+		if err != nil {
+			return nil, fmt.Errorf("watch entry %s: when: %v", watchName(w), err)
+		}
+
+		if !holds {
+			log.Infof("Excluding watch entry %s: %s is false", watchName(w), w.When)
+			continue
+		}
+		result = append(result, w)
+	}
+
+	return result, nil
+}
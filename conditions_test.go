@@ -0,0 +1,159 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPatterns(t *testing.T) {
+	testCases := map[string]struct {
+		Patterns []string
+		Name     string
+		Expected bool
+	}{
+		"exact":            {[]string{"main"}, "main", true},
+		"glob":             {[]string{"release/*"}, "release/1.0", true},
+		"no match":         {[]string{"main", "release/*"}, "feature/foo", false},
+		"nested glob":      {[]string{"release/**"}, "release/1.0/rc", true},
+		"negated":          {[]string{"release/*", "!release/old"}, "release/old", false},
+		"only negated":     {[]string{"!main"}, "feature/foo", false},
+		"negated no match": {[]string{"release/*", "!release/old"}, "release/new", true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, matchPatterns(tc.Patterns, tc.Name))
+		})
+	}
+}
+
+func TestExcludedBy(t *testing.T) {
+	testCases := map[string]struct {
+		Watch    WatchConfig
+		Branch   string
+		Tag      string
+		Expected string
+	}{
+		"no conditions": {
+			Watch:    WatchConfig{},
+			Branch:   "feature/foo",
+			Expected: "",
+		},
+		"matching branch": {
+			Watch:    WatchConfig{Branches: []string{"main", "release/*"}},
+			Branch:   "release/1.0",
+			Expected: "",
+		},
+		"other branch": {
+			Watch:    WatchConfig{Branches: []string{"main", "release/*"}},
+			Branch:   "feature/foo",
+			Expected: `branch "feature/foo" does not match main, release/*`,
+		},
+		"matching tag": {
+			Watch:    WatchConfig{Branches: []string{"main"}, Tags: []string{"v*"}},
+			Branch:   "v1.0.0",
+			Tag:      "v1.0.0",
+			Expected: "",
+		},
+		"not a tag build": {
+			Watch:    WatchConfig{Tags: []string{"v*"}},
+			Branch:   "main",
+			Expected: `tag "" does not match v*`,
+		},
+		"neither branch nor tag": {
+			Watch:    WatchConfig{Branches: []string{"main"}, Tags: []string{"v*"}},
+			Branch:   "feature/foo",
+			Expected: `branch "feature/foo" does not match main and tag "" does not match v*`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, excludedBy(tc.Watch, tc.Branch, tc.Tag))
+		})
+	}
+}
+
+func TestUploadPipelineFiltersWatchByBranch(t *testing.T) {
+	t.Setenv("BUILDKITE_BRANCH", "feature/foo")
+
+	plugin := Plugin{
+		Diff: "echo service-1/main.go",
+		Watch: []WatchConfig{
+			{
+				Paths:    []string{"service-1/"},
+				Step:     Step{Trigger: "deploy-service-1"},
+				Branches: []string{"main"},
+			},
+			{
+				Paths: []string{"service-1/"},
+				Step:  Step{Command: "make test"},
+			},
+			{
+				Default:  true,
+				Step:     Step{Command: "echo default"},
+				Branches: []string{"main"},
+			},
+		},
+	}
+
+	var got []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Command: "make test"}}, got)
+
+	agent.CheckAndClose(t)
+}
+
+func TestWithMatchingCondition(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			Paths: []string{"service-a/"},
+			Step:  Step{Trigger: "service-a"},
+			When:  "changes.matched > 1",
+		},
+		{
+			Paths: []string{"service-b/"},
+			Step:  Step{Trigger: "service-b"},
+			When:  `changes.matched_files includes "service-b/go.mod"`,
+		},
+		{
+			Paths: []string{"service-c/"},
+			Step:  Step{Trigger: "service-c"},
+		},
+	}
+
+	files := []string{"service-a/main.go", "service-a/go.mod", "service-b/main.go"}
+
+	got, err := withMatchingCondition(watch, files)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []WatchConfig{watch[0], watch[2]}, got)
+}
+
+func TestWithMatchingConditionFails(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			ID:    "service-a",
+			Paths: []string{"service-a/"},
+			When:  `build.branch =~ env.PATTERN`,
+		},
+	}
+	t.Setenv("PATTERN", "(")
+
+	_, err := withMatchingCondition(watch, []string{})
+
+	assert.EqualError(t, err, `watch entry service-a: when: invalid regular expression "("`)
+}
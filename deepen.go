@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults for deepening shallow clones
+const (
+	defaultDeepenMaxDepth = 1000
+	defaultDeepenStep     = 50
+	defaultDeepenRemote   = "origin"
+)
+
+// DeepenConfig is the configuration for deepening shallow clones
+// until the history the diff needs is available
+type DeepenConfig struct {
+	MaxDepth  int    `json:"max_depth"`
+	Step      int    `json:"step"`
+	Remote    string `json:"remote"`
+	MergeBase string `json:"merge_base"`
+}
+
+var commitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+func (c *DeepenConfig) setDefaults() error {
+	if c.MaxDepth < 0 {
+		return errors.New("deepen: max_depth must not be negative")
+	}
+
+	if c.Step < 0 {
+		return errors.New("deepen: step must not be negative")
+	}
+
+	if c.MaxDepth == 0 {
+		c.MaxDepth = defaultDeepenMaxDepth
+	}
+
+	if c.Step == 0 {
+		c.Step = defaultDeepenStep
+	}
+
+	if c.Remote == "" {
+		c.Remote = defaultDeepenRemote
+	}
+
+	return nil
+}
+
+// deepen fetches more history into a shallow clone, until the commits the
+// diff needs are available or max_depth commits have been fetched.
+func deepen(plugin Plugin) error {
+	config := plugin.Deepen
+	if config == nil || !isShallow() {
+		return nil
+	}
+
+	base := baseRef(plugin)
+	ready := func() bool {
+		return historyAvailable(plugin, base)
+	}
+
+	if ready() {
+		return nil
+	}
+
+	if commitHash.MatchString(base) {
+		log.Infof("Fetching base commit %s from %s", base, config.Remote)
+
+		if _, err := executeCommand("git", []string{"fetch", "--no-tags", "--depth=1", config.Remote, base}); err != nil {
+			log.Warnf("could not fetch base commit %s: %v", base, err)
+		} else if ready() {
+			return nil
+		}
+	}
+
+	for depth := 0; depth < config.MaxDepth; {
+		step := config.Step
+		if depth+step > config.MaxDepth {
+			step = config.MaxDepth - depth
+		}
+		depth += step
+
+		log.Infof("Deepening shallow clone by %d commits (%d of %d)", step, depth, config.MaxDepth)
+
+		args := []string{"fetch", "--no-tags", "--deepen=" + strconv.Itoa(step), config.Remote}
+		if _, err := executeCommand("git", args); err != nil {
+			return fmt.Errorf("could not deepen shallow clone: %v", err)
+		}
+
+		if ready() {
+			return nil
+		}
+
+		if !isShallow() {
+			break
+		}
+	}
+
+	return fmt.Errorf("history needed by the diff is not available after deepening by %d commits", config.MaxDepth)
+}
+
+// historyAvailable checks whether the commits the diff needs are in the
+// clone: the base commit, the merge base, or else the diff itself succeeds.
+func historyAvailable(plugin Plugin, base string) bool {
+	config := plugin.Deepen
+
+	if base == "" && config.MergeBase == "" {
+		_, err := diffWithTimeout(plugin.Diff, plugin.DiffTimeout)
+		return err == nil
+	}
+
+	if base != "" {
+		if _, err := executeCommand("git", []string{"cat-file", "-e", base + "^{commit}"}); err != nil {
+			return false
+		}
+	}
+
+	if config.MergeBase != "" {
+		if _, err := executeCommand("git", []string{"merge-base", "HEAD", config.MergeBase}); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+func isShallow() bool {
+	output, err := executeCommand("git", []string{"rev-parse", "--is-shallow-repository"})
+	if err != nil {
+		log.Debugf("could not tell if the repository is shallow: %v", err)
+		return false
+	}
+
+	return strings.TrimSpace(output) == "true"
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+	)
+
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	return strings.TrimSpace(string(output))
+}
+
+// newRemote creates a bare repository with commits commits on main,
+// and returns its path along with a working copy pushing to it.
+func newRemote(t *testing.T, commits int) (string, string) {
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+	work := filepath.Join(dir, "work")
+
+	git(t, dir, "init", "--quiet", "--bare", "--initial-branch=main", remote)
+	git(t, dir, "clone", "--quiet", remote, work)
+	git(t, work, "checkout", "--quiet", "-b", "main")
+	commit(t, work, "main", commits)
+
+	return remote, work
+}
+
+// commit adds commits commits to the current branch of work, each
+// adding a file named after prefix, and pushes them.
+func commit(t *testing.T, work string, prefix string, commits int) {
+	for i := 0; i < commits; i++ {
+		name := prefix + "-" + strconv.Itoa(i)
+		require.NoError(t, os.WriteFile(filepath.Join(work, name), []byte(name), 0o644))
+
+		git(t, work, "add", ".")
+		git(t, work, "commit", "--quiet", "-m", name)
+	}
+
+	git(t, work, "push", "--quiet", "origin", "HEAD")
+}
+
+// shallowClone clones the branch of the remote with a depth of 1,
+// and makes it the working directory for the rest of the test.
+func shallowClone(t *testing.T, remote string, branch string) string {
+	clone := filepath.Join(t.TempDir(), "clone")
+	git(t, ".", "clone", "--quiet", "--depth=1", "--no-single-branch", "--branch", branch, "file://"+remote, clone)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Chdir(wd) })
+	require.NoError(t, os.Chdir(clone))
+
+	return clone
+}
+
+func TestDeepenFetchesParentCommit(t *testing.T) {
+	remote, _ := newRemote(t, 5)
+	clone := shallowClone(t, remote, "main")
+
+	plugin := Plugin{
+		Diff:   defaultDiff,
+		Deepen: &DeepenConfig{MaxDepth: 10, Step: 1, Remote: "origin"},
+	}
+
+	require.NoError(t, deepen(plugin))
+
+	assert.Equal(t, "2", git(t, clone, "rev-list", "--count", "HEAD"))
+	assert.Equal(t, "main-4", git(t, clone, "diff", "--name-only", "HEAD~1"))
+}
+
+func TestDeepenFetchesBaseCommit(t *testing.T) {
+	remote, work := newRemote(t, 5)
+	base := git(t, work, "rev-parse", "HEAD~3")
+	clone := shallowClone(t, remote, "main")
+
+	plugin := Plugin{
+		Diff:       "git diff --name-only " + base,
+		BaseCommit: base,
+		Deepen:     &DeepenConfig{MaxDepth: 10, Step: 1, Remote: "origin"},
+	}
+
+	require.NoError(t, deepen(plugin))
+
+	assert.Equal(t, "1", git(t, clone, "rev-list", "--count", "HEAD"))
+	assert.Equal(t, "main-2\nmain-3\nmain-4", git(t, clone, "diff", "--name-only", base))
+}
+
+func TestDeepenFindsMergeBase(t *testing.T) {
+	remote, work := newRemote(t, 3)
+	git(t, work, "checkout", "--quiet", "-b", "feature")
+	commit(t, work, "feature", 5)
+	git(t, work, "checkout", "--quiet", "main")
+	commit(t, work, "update", 2)
+	clone := shallowClone(t, remote, "feature")
+
+	plugin := Plugin{
+		Diff:   "git diff --name-only origin/main...HEAD",
+		Deepen: &DeepenConfig{MaxDepth: 20, Step: 2, Remote: "origin", MergeBase: "origin/main"},
+	}
+
+	require.NoError(t, deepen(plugin))
+
+	got := git(t, clone, "diff", "--name-only", "origin/main...HEAD")
+	assert.Equal(t, "feature-0\nfeature-1\nfeature-2\nfeature-3\nfeature-4", got)
+}
+
+func TestDeepenUsesDiffWithoutKnownBase(t *testing.T) {
+	remote, _ := newRemote(t, 10)
+	clone := shallowClone(t, remote, "main")
+
+	plugin := Plugin{
+		Diff:   "git diff --name-only HEAD~4",
+		Deepen: &DeepenConfig{MaxDepth: 10, Step: 3, Remote: "origin"},
+	}
+
+	require.NoError(t, deepen(plugin))
+
+	assert.Equal(t, "7", git(t, clone, "rev-list", "--count", "HEAD"))
+}
+
+func TestDeepenStopsAtMaxDepth(t *testing.T) {
+	remote, _ := newRemote(t, 10)
+	clone := shallowClone(t, remote, "main")
+
+	plugin := Plugin{
+		Diff:   "git diff --name-only HEAD~8",
+		Deepen: &DeepenConfig{MaxDepth: 3, Step: 2, Remote: "origin"},
+	}
+
+	err := deepen(plugin)
+
+	assert.EqualError(t, err, "history needed by the diff is not available after deepening by 3 commits")
+	assert.Equal(t, "4", git(t, clone, "rev-list", "--count", "HEAD"))
+}
+
+func TestDeepenIgnoresCompleteClones(t *testing.T) {
+	_, work := newRemote(t, 3)
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Chdir(wd) })
+	require.NoError(t, os.Chdir(work))
+
+	plugin := Plugin{
+		Diff:   "git diff --name-only HEAD~8",
+		Deepen: &DeepenConfig{MaxDepth: 3, Step: 2, Remote: "missing"},
+	}
+
+	assert.NoError(t, deepen(plugin))
+}
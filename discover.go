@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// discoverWatch loads the watch entries of the files matching the
+// patterns, with their paths relative to the directory of their file.
+func discoverWatch(patterns []string, templates map[string]interface{}) ([]WatchConfig, []string, error) {
+	files := []string{}
+
+	for _, pattern := range patterns {
+		matches, err := doublestar.Glob(pattern)
+		if err != nil {
+			return nil, nil, fmt.Errorf("discover: invalid pattern %s: %v", pattern, err)
+		}
+
+		for _, match := range matches {
+			files = appendUnique(files, path.Clean(match))
+		}
+	}
+
+	sort.Strings(files)
+
+	var watch []WatchConfig
+	var labels []string
+
+	for _, file := range files {
+		log.Debugf("Discovered watch file %s", file)
+
+		entries, fileLabels, err := loadWatchFile(file, templates)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for i := range entries {
+			entries[i].Dir = path.Dir(file)
+		}
+
+		watch = append(watch, entries...)
+		labels = append(labels, fileLabels...)
+	}
+
+	return watch, labels, nil
+}
+
+// inDir resolves the watch path p relative to dir, keeping the trailing
+// slash of prefixes, and rejects paths escaping dir.
+func inDir(dir string, p string) (string, error) {
+	joined := path.Join(dir, p)
+
+	escapes := joined == ".." || strings.HasPrefix(joined, "../")
+	if dir != "." {
+		escapes = escapes || (joined != dir && !strings.HasPrefix(joined, dir+"/"))
+	}
+
+	if path.IsAbs(p) || escapes {
+		return "", fmt.Errorf("path %s escapes %s", p, dir)
+	}
+
+	if joined == "." {
+		return "", nil
+	}
+
+	if p == "" || p == "." || strings.HasSuffix(p, "/") {
+		joined += "/"
+	}
+
+	return joined, nil
+}
+
+// checkIDs rejects watch entries sharing an id.
+func checkIDs(watch []WatchConfig, labels []string) error {
+	seen := map[string]int{}
+
+	for i, w := range watch {
+		if w.ID == "" {
+			continue
+		}
+
+		if first, ok := seen[w.ID]; ok {
+			return fmt.Errorf("%s: id %s is already used by %s", labels[i], w.ID, labels[first])
+		}
+		seen[w.ID] = i
+	}
+
+	return nil
+}
+
+// checkDefaults rejects fallback default entries defined in several
+// discovered files, or both in a discovered file and in the plugin
+// configuration, as it is not clear which should apply.
+func checkDefaults(watch []WatchConfig, labels []string) error {
+	first := -1
+
+	for i, w := range watch {
+		if w.Default == nil || w.DefaultMode == defaultModeAlways {
+			continue
+		}
+
+		if first < 0 {
+			first = i
+			continue
+		}
+
+		if w.Dir != watch[first].Dir {
+			return fmt.Errorf("%s: default conflicts with the default of %s", labels[i], labels[first])
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInDir(t *testing.T) {
+	testCases := map[string]struct {
+		Dir      string
+		Path     string
+		Expected string
+		Error    string
+	}{
+		"prefix":            {Dir: "services/a", Path: "src/", Expected: "services/a/src/"},
+		"file":              {Dir: "services/a", Path: "go.mod", Expected: "services/a/go.mod"},
+		"glob":              {Dir: "services/a", Path: "**/*.go", Expected: "services/a/**/*.go"},
+		"directory":         {Dir: "services/a", Path: ".", Expected: "services/a/"},
+		"root directory":    {Dir: ".", Path: "docs/", Expected: "docs/"},
+		"whole root":        {Dir: ".", Path: ".", Expected: ""},
+		"parent":            {Dir: "services/a", Path: "../b/", Error: "path ../b/ escapes services/a"},
+		"parent of root":    {Dir: ".", Path: "../b/", Error: "path ../b/ escapes ."},
+		"absolute":          {Dir: "services/a", Path: "/etc/", Error: "path /etc/ escapes services/a"},
+		"nested parent":     {Dir: "services/a", Path: "src/../../b", Error: "path src/../../b escapes services/a"},
+		"parent and back":   {Dir: "services/a", Path: "../a/src/", Expected: "services/a/src/"},
+		"sibling with same": {Dir: "services/a", Path: "../ab/", Error: "path ../ab/ escapes services/a"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := inDir(tc.Dir, tc.Path)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestCheckIDs(t *testing.T) {
+	watch := []WatchConfig{{ID: "a"}, {}, {}, {ID: "b"}, {ID: "a"}}
+	labels := []string{"watch[0]", "watch[1]", "x.yml:1: watch[0]", "x.yml:4: watch[1]", "y.yml:1: watch[0]"}
+
+	assert.NoError(t, checkIDs(watch[:4], labels))
+	assert.EqualError(t, checkIDs(watch, labels), "y.yml:1: watch[0]: id a is already used by watch[0]")
+}
+
+func TestCheckDefaults(t *testing.T) {
+	testCases := map[string]struct {
+		Watch []WatchConfig
+		Error string
+	}{
+		"same source": {
+			Watch: []WatchConfig{{Default: true}, {Default: true}, {Dir: "a", Paths: []string{"a/"}}},
+		},
+		"always defaults": {
+			Watch: []WatchConfig{{Default: true}, {Default: true, Dir: "a", DefaultMode: defaultModeAlways}},
+		},
+		"plugin and discovered": {
+			Watch: []WatchConfig{{Default: true}, {Paths: []string{"b/"}}, {Default: true, Dir: "a"}},
+			Error: "watch[2]: default conflicts with the default of watch[0]",
+		},
+		"two discovered": {
+			Watch: []WatchConfig{{Paths: []string{"c/"}}, {Default: true, Dir: "a"}, {Default: true, Dir: "b"}},
+			Error: "watch[2]: default conflicts with the default of watch[1]",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			labels := []string{"watch[0]", "watch[1]", "watch[2]"}
+			err := checkDefaults(tc.Watch, labels)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+		})
+	}
+}
+
+// chdirTemp makes a new temporary directory with files the working
+// directory for the rest of the test.
+func chdirTemp(t *testing.T, files map[string]string) {
+	dir := t.TempDir()
+
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
+		require.NoError(t, os.WriteFile(file, []byte(content), 0o644))
+	}
+
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Chdir(wd) })
+	require.NoError(t, os.Chdir(dir))
+}
+
+func TestPluginDiscover(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"services/a/.monorepo-diff.yml": `
+- id: service-a
+  path: .
+  skip_path: docs/
+  config:
+    command: make -C services/a test
+`,
+		"services/b/.monorepo-diff.yml": `
+watch:
+  - id: service-b
+    path: ["src/", "go.*"]
+    config:
+      command: make -C services/b test
+`,
+		"services/c/README.md": "not a watch file",
+	})
+
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"discover": "services/*/.monorepo-diff.yml",
+			"watch": [{"path": "docs/", "config": {"command": "make docs"}}]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"services/*/.monorepo-diff.yml"}, got.Discover)
+	require.Len(t, got.Watch, 3)
+
+	assert.Equal(t, []string{"docs/"}, got.Watch[0].Paths)
+	assert.Equal(t, "", got.Watch[0].Dir)
+
+	assert.Equal(t, "service-a", got.Watch[1].ID)
+	assert.Equal(t, "services/a", got.Watch[1].Dir)
+	assert.Equal(t, []string{"services/a/"}, got.Watch[1].Paths)
+	assert.Equal(t, []string{"services/a/docs/"}, got.Watch[1].SkipPaths)
+
+	assert.Equal(t, "service-b", got.Watch[2].ID)
+	assert.Equal(t, []string{"services/b/src/", "services/b/go.*"}, got.Watch[2].Paths)
+
+	steps, err := stepsToTrigger([]string{"services/a/main.go", "services/a/docs/index.md", "services/b/go.sum"}, got.Watch)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Command: "make -C services/a test"},
+		{Command: "make -C services/b test"},
+	}, steps)
+}
+
+func TestPluginDiscoverErrors(t *testing.T) {
+	testCases := map[string]struct {
+		Files map[string]string
+		Error string
+	}{
+		"duplicate id": {
+			Files: map[string]string{
+				"services/a/.monorepo-diff.yml": "- id: service\n  path: .\n",
+				"services/b/.monorepo-diff.yml": "- path: .\n\n- id: service\n  path: .\n",
+			},
+			Error: "services/b/.monorepo-diff.yml:3: watch[1]: id service is already used by services/a/.monorepo-diff.yml:1: watch[0]",
+		},
+		"escaping path": {
+			Files: map[string]string{
+				"services/a/.monorepo-diff.yml": "- path: ../b/\n",
+			},
+			Error: "services/a/.monorepo-diff.yml:1: watch[0]: path ../b/ escapes services/a",
+		},
+		"conflicting defaults": {
+			Files: map[string]string{
+				"services/a/.monorepo-diff.yml": "- default:\n    command: make a\n",
+				"services/b/.monorepo-diff.yml": "- default:\n    command: make b\n",
+			},
+			Error: "services/b/.monorepo-diff.yml:1: watch[0]: default conflicts with the default of services/a/.monorepo-diff.yml:1: watch[0]",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			chdirTemp(t, tc.Files)
+
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"discover": ["services/*/.monorepo-diff.yml"]
+				}
+			}]`
+
+			_, err := initializePlugin(param)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+tc.Error)
+		})
+	}
+}
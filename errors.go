@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errorKind is the stage of the plugin an error happened in
+type errorKind int
+
+const (
+	configError errorKind = iota + 1
+	diffError
+	matchError
+	generationError
+	uploadError
+)
+
+// PluginError is an error tagged with the stage of the plugin it happened in,
+// so that main can report it and exit with a distinct code.
+type PluginError struct {
+	Kind errorKind
+	Err  error
+}
+
+func (e *PluginError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PluginError) Unwrap() error {
+	return e.Err
+}
+
+// newError tags err with kind, unless err is nil or already tagged.
+func newError(kind errorKind, err error) error {
+	var pluginErr *PluginError
+	if err == nil || errors.As(err, &pluginErr) {
+		return err
+	}
+
+	return &PluginError{Kind: kind, Err: err}
+}
+
+// exitCode returns the exit code of the plugin for err. Errors that
+// are not tagged with a stage exit with 1.
+func exitCode(err error) int {
+	var pluginErr *PluginError
+	if err == nil {
+		return 0
+	}
+
+	if !errors.As(err, &pluginErr) {
+		return 1
+	}
+
+	switch pluginErr.Kind {
+	case configError:
+		return 2
+	case diffError:
+		return 3
+	case matchError:
+		return 4
+	case generationError:
+		return 5
+	case uploadError:
+		return 6
+	}
+
+	return 1
+}
+
+// describe returns a human readable message for err.
+func describe(err error) string {
+	var pluginErr *PluginError
+	if !errors.As(err, &pluginErr) {
+		return err.Error()
+	}
+
+	stages := map[errorKind]string{
+		configError:     "invalid plugin configuration",
+		diffError:       "could not compute the changed files",
+		matchError:      "could not match the changed files",
+		generationError: "could not generate the pipeline",
+		uploadError:     "could not upload the pipeline",
+	}
+
+	return fmt.Sprintf("%s: %v", stages[pluginErr.Kind], pluginErr.Err)
+}
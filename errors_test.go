@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewError(t *testing.T) {
+	assert.Nil(t, newError(diffError, nil))
+
+	err := newError(diffError, errors.New("git blew up"))
+	assert.EqualError(t, err, "git blew up")
+
+	// an error keeps the stage it was first tagged with
+	assert.Equal(t, err, newError(uploadError, err))
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := map[string]struct {
+		Err      error
+		Expected int
+	}{
+		"no error":         {nil, 0},
+		"untagged":         {errors.New("oops"), 1},
+		"config error":     {newError(configError, errors.New("oops")), 2},
+		"diff error":       {newError(diffError, errors.New("oops")), 3},
+		"match error":      {newError(matchError, errors.New("oops")), 4},
+		"generation error": {newError(generationError, errors.New("oops")), 5},
+		"upload error":     {newError(uploadError, errors.New("oops")), 6},
+		"wrapped":          {fmt.Errorf("wrapped: %w", newError(uploadError, errors.New("oops"))), 6},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, exitCode(tc.Err))
+		})
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	assert.Equal(t, "oops", describe(errors.New("oops")))
+	assert.Equal(t,
+		"could not compute the changed files: git blew up",
+		describe(newError(diffError, errors.New("git blew up"))),
+	)
+	assert.Equal(t,
+		"invalid plugin configuration: could not initialize plugin",
+		describe(newError(configError, errors.New("could not initialize plugin"))),
+	)
+}
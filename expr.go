@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// exprType is the type of a `when` expression or of one of its operands
+type exprType int
+
+const (
+	boolType exprType = iota
+	stringType
+	numberType
+	listType
+)
+
+func (t exprType) String() string {
+	return [...]string{"bool", "string", "number", "list"}[t]
+}
+
+// buildVars maps the build.* identifiers to the Buildkite env vars
+var buildVars = map[string]string{
+	"branch":       "BUILDKITE_BRANCH",
+	"tag":          "BUILDKITE_TAG",
+	"source":       "BUILDKITE_SOURCE",
+	"message":      "BUILDKITE_MESSAGE",
+	"commit":       "BUILDKITE_COMMIT",
+	"pipeline":     "BUILDKITE_PIPELINE_SLUG",
+	"pull_request": "BUILDKITE_PULL_REQUEST",
+	"creator":      "BUILDKITE_BUILD_CREATOR_EMAIL",
+}
+
+// changesVars are the types of the changes.* identifiers
+var changesVars = map[string]exprType{
+	"count":         numberType,
+	"matched":       numberType,
+	"files":         listType,
+	"matched_files": listType,
+}
+
+// exprContext is what a `when` expression is evaluated against: the
+// changed files, and those matched by the watch entry.
+type exprContext struct {
+	Files   []string
+	Matched []string
+}
+
+func (c exprContext) lookup(name string) interface{} {
+	scope, field, _ := strings.Cut(name, ".")
+
+	switch scope {
+	case "build":
+		return env(buildVars[field], "")
+	case "env":
+		return env(field, "")
+	}
+
+	switch field {
+	case "count":
+		return len(c.Files)
+	case "matched":
+		return len(c.Matched)
+	case "files":
+		return c.Files
+	}
+
+	return c.Matched
+}
+
+// expr is a node of a parsed `when` expression
+type expr interface {
+	check() (exprType, error)
+	eval(ctx exprContext) (interface{}, error)
+}
+
+type literalExpr struct {
+	value interface{}
+	typ   exprType
+}
+
+type identExpr struct {
+	name string
+}
+
+type notExpr struct {
+	operand expr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+// parseExpression parses and type-checks a `when` expression.
+func parseExpression(source string) (expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != eofToken {
+		return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+	}
+
+	typ, err := e.check()
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != boolType {
+		return nil, fmt.Errorf("expression is a %s, expected a bool", typ)
+	}
+
+	return e, nil
+}
+
+// evalCondition evaluates a parsed `when` expression to a bool.
+func evalCondition(e expr, ctx exprContext) (bool, error) {
+	value, err := e.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	return value.(bool), nil
+}
+
+func (e literalExpr) check() (exprType, error) {
+	return e.typ, nil
+}
+
+func (e literalExpr) eval(exprContext) (interface{}, error) {
+	return e.value, nil
+}
+
+func (e identExpr) check() (exprType, error) {
+	scope, field, ok := strings.Cut(e.name, ".")
+	if ok && field != "" {
+		switch scope {
+		case "build":
+			if _, ok := buildVars[field]; ok {
+				return stringType, nil
+			}
+		case "env":
+			return stringType, nil
+		case "changes":
+			if typ, ok := changesVars[field]; ok {
+				return typ, nil
+			}
+		}
+	}
+
+	return 0, fmt.Errorf("unknown identifier %s", e.name)
+}
+
+func (e identExpr) eval(ctx exprContext) (interface{}, error) {
+	return ctx.lookup(e.name), nil
+}
+
+func (e notExpr) check() (exprType, error) {
+	typ, err := e.operand.check()
+	if err != nil {
+		return 0, err
+	}
+
+	if typ != boolType {
+		return 0, fmt.Errorf("! expects a bool, got a %s", typ)
+	}
+
+	return boolType, nil
+}
+
+func (e notExpr) eval(ctx exprContext) (interface{}, error) {
+	value, err := e.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return !value.(bool), nil
+}
+
+func (e binaryExpr) check() (exprType, error) {
+	left, err := e.left.check()
+	if err != nil {
+		return 0, err
+	}
+
+	right, err := e.right.check()
+	if err != nil {
+		return 0, err
+	}
+
+	mismatch := func(expected string) error {
+		return fmt.Errorf("%s expects %s, got a %s and a %s", e.op, expected, left, right)
+	}
+
+	switch e.op {
+	case "&&", "||":
+		if left != boolType || right != boolType {
+			return 0, mismatch("bools")
+		}
+	case "==", "!=":
+		if left != right || left == listType {
+			return 0, mismatch("two operands of the same type")
+		}
+	case "<", "<=", ">", ">=":
+		if left != numberType || right != numberType {
+			return 0, mismatch("numbers")
+		}
+	case "=~", "!~":
+		if left != stringType || right != stringType {
+			return 0, mismatch("strings")
+		}
+
+		if pattern, ok := e.right.(literalExpr); ok {
+			if _, err := regexp.Compile(pattern.value.(string)); err != nil {
+				return 0, fmt.Errorf("invalid regular expression %q", pattern.value)
+			}
+		}
+	case "includes":
+		if left != listType || right != stringType {
+			return 0, mismatch("a list and a string")
+		}
+	}
+
+	return boolType, nil
+}
+
+func (e binaryExpr) eval(ctx exprContext) (interface{}, error) {
+	left, err := e.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// && and || short-circuit
+	switch e.op {
+	case "&&":
+		if !left.(bool) {
+			return false, nil
+		}
+		return e.right.eval(ctx)
+	case "||":
+		if left.(bool) {
+			return true, nil
+		}
+		return e.right.eval(ctx)
+	}
+
+	right, err := e.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "<":
+		return left.(int) < right.(int), nil
+	case "<=":
+		return left.(int) <= right.(int), nil
+	case ">":
+		return left.(int) > right.(int), nil
+	case ">=":
+		return left.(int) >= right.(int), nil
+	case "=~", "!~":
+		pattern, err := regexp.Compile(right.(string))
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q", right)
+		}
+		return pattern.MatchString(left.(string)) == (e.op == "=~"), nil
+	case "includes":
+		for _, item := range left.([]string) {
+			if item == right.(string) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return nil, fmt.Errorf("unknown operator %s", e.op)
+}
+
+type tokenKind int
+
+const (
+	eofToken tokenKind = iota
+	identToken
+	stringToken
+	numberToken
+	operatorToken
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case eofToken:
+		return "end of expression"
+	case stringToken:
+		return strconv.Quote(t.value)
+	}
+
+	return t.value
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "(", ")"}
+
+func tokenize(source string) ([]token, error) {
+	tokens := []token{}
+	runes := []rune(source)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '"' || r == '\'':
+			var value strings.Builder
+			start := i
+
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+
+			if i == len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+
+			tokens = append(tokens, token{stringToken, value.String(), start})
+			i++
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{numberToken, string(runes[start:i]), start})
+
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{identToken, string(runes[start:i]), start})
+
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(string(runes[i:]), op) {
+					tokens = append(tokens, token{operatorToken, op, i})
+					i += len([]rune(op))
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+		}
+	}
+
+	return append(tokens, token{eofToken, "", len(runes)}), nil
+}
+
+// exprParser is a recursive descent parser for `when` expressions, from
+// the lowest precedence to the highest: ||, &&, comparisons, !, operands.
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != eofToken {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) isOperator(ops ...string) bool {
+	tok := p.peek()
+	if tok.kind != operatorToken && !(tok.kind == identToken && tok.value == "includes") {
+		return false
+	}
+
+	for _, op := range ops {
+		if tok.value == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *exprParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("||") {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{"||", left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (expr, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOperator("&&") {
+		p.next()
+
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{"&&", left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseComparison() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOperator("==", "!=", "<", "<=", ">", ">=", "=~", "!~", "includes") {
+		op := p.next().value
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op, left, right}
+	}
+
+	return left, nil
+}
+
+func (p *exprParser) parseUnary() (expr, error) {
+	if p.isOperator("!") {
+		p.next()
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{operand}, nil
+	}
+
+	return p.parseOperand()
+}
+
+func (p *exprParser) parseOperand() (expr, error) {
+	tok := p.next()
+
+	switch tok.kind {
+	case stringToken:
+		return literalExpr{tok.value, stringType}, nil
+
+	case numberToken:
+		n, err := strconv.Atoi(tok.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s at position %d", tok.value, tok.pos)
+		}
+		return literalExpr{n, numberType}, nil
+
+	case identToken:
+		switch tok.value {
+		case "true", "false":
+			return literalExpr{tok.value == "true", boolType}, nil
+		case "includes":
+			return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+		}
+		return identExpr{tok.value}, nil
+
+	case operatorToken:
+		if tok.value == "(" {
+			e, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if closing := p.next(); closing.value != ")" || closing.kind != operatorToken {
+				return nil, fmt.Errorf("expected ) at position %d, got %s", closing.pos, closing)
+			}
+			return e, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected %s at position %d", tok, tok.pos)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvalCondition(t *testing.T) {
+	t.Setenv("BUILDKITE_SOURCE", "schedule")
+	t.Setenv("DEPLOY", "1")
+
+	ctx := exprContext{
+		Files:   []string{"service-a/main.go", "service-a/go.mod", "README.md"},
+		Matched: []string{"service-a/main.go", "service-a/go.mod"},
+	}
+
+	testCases := map[string]bool{
+		`build.source == "schedule"`:                                   true,
+		`build.source == 'webhook' || env.DEPLOY == "1"`:               true,
+		`build.source == "schedule" && env.DEPLOY != "1"`:              false,
+		`!(build.branch == "main")`:                                    true,
+		`build.branch == "go-rewrite"`:                                 true,
+		`env.MISSING == ""`:                                            true,
+		`changes.count > 2`:                                            true,
+		`changes.count >= 4`:                                           false,
+		`changes.matched == 2 && changes.matched <= 2`:                 true,
+		`changes.matched < 1`:                                          false,
+		`changes.matched_files includes "service-a/go.mod"`:            true,
+		`changes.files includes "docs/index.md"`:                       false,
+		`build.message =~ "^fix:"`:                                     true,
+		`build.message !~ "deleted$"`:                                  false,
+		`true && !false`:                                               true,
+		`build.source == "schedule" || changes.count > 100 && false`:   true,
+		`(build.source == "schedule" || changes.count > 100) && false`: false,
+	}
+
+	for source, expected := range testCases {
+		t.Run(source, func(t *testing.T) {
+			e, err := parseExpression(source)
+			require.NoError(t, err)
+
+			got, err := evalCondition(e, ctx)
+
+			assert.NoError(t, err)
+			assert.Equal(t, expected, got)
+		})
+	}
+}
+
+func TestParseExpressionErrors(t *testing.T) {
+	testCases := map[string]string{
+		`build.source`:                           "expression is a string, expected a bool",
+		`build.foo == "bar"`:                     "unknown identifier build.foo",
+		`deploy == "1"`:                          "unknown identifier deploy",
+		`changes.count == "1"`:                   "== expects two operands of the same type, got a number and a string",
+		`changes.files == changes.matched_files`: "== expects two operands of the same type, got a list and a list",
+		`build.branch > 1`:                       "> expects numbers, got a string and a number",
+		`changes.count && true`:                  "&& expects bools, got a number and a bool",
+		`!build.branch`:                          "! expects a bool, got a string",
+		`build.branch includes "main"`:           "includes expects a list and a string, got a string and a string",
+		`build.branch =~ "("`:                    `invalid regular expression "("`,
+		`build.branch == "main`:                  "unterminated string at position 16",
+		`build.branch = "main"`:                  "unexpected character '=' at position 13",
+		`(build.branch == "main"`:                "expected ) at position 23, got end of expression",
+		`build.branch == "main" "release"`:       `unexpected "release" at position 23`,
+		`includes`:                               "unexpected includes at position 0",
+		``:                                       "unexpected end of expression at position 0",
+	}
+
+	for source, expected := range testCases {
+		t.Run(source, func(t *testing.T) {
+			_, err := parseExpression(source)
+
+			assert.EqualError(t, err, expected)
+		})
+	}
+}
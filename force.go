@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// ForceAllConfig lists the sources that make every watch entry trigger,
+// regardless of the changes
+type ForceAllConfig struct {
+	Message  string   `json:"message"`
+	Env      string   `json:"env"`
+	MetaData string   `json:"meta_data"`
+	Branches []string `json:"branches"`
+}
+
+// skipMarker matches `[ci skip id, ...]` in a commit message
+var skipMarker = regexp.MustCompile(`\[ci skip ([^\]]+)\]`)
+
+// forceAllReason returns why every watch entry should trigger,
+// or an empty string if none of the configured sources is set.
+func forceAllReason(agent string, config ForceAllConfig) (string, error) {
+	if config.Message != "" && strings.Contains(env("BUILDKITE_MESSAGE", ""), config.Message) {
+		return fmt.Sprintf("commit message contains %s", config.Message), nil
+	}
+
+	if config.Env != "" && isTruthy(env(config.Env, "")) {
+		return fmt.Sprintf("%s is set", config.Env), nil
+	}
+
+	if config.MetaData != "" {
+		value, err := getMetaData(agent, config.MetaData)
+		if err != nil {
+			return "", fmt.Errorf("could not read meta-data %s: %v", config.MetaData, err)
+		}
+
+		if isTruthy(value) {
+			return fmt.Sprintf("meta-data %s is set", config.MetaData), nil
+		}
+	}
+
+	branch := env("BUILDKITE_BRANCH", "")
+	for _, pattern := range config.Branches {
+		match, err := doublestar.Match(pattern, branch)
+		if err != nil {
+			return "", fmt.Errorf("invalid branch pattern %s: %v", pattern, err)
+		}
+
+		if match {
+			return fmt.Sprintf("branch %s matches %s", branch, pattern), nil
+		}
+	}
+
+	return "", nil
+}
+
+// skippedIDs returns the watch entry ids listed in `[ci skip ...]`
+// markers of the commit message.
+func skippedIDs(message string) map[string]bool {
+	ids := map[string]bool{}
+
+	for _, marker := range skipMarker.FindAllStringSubmatch(message, -1) {
+		for _, id := range strings.FieldsFunc(marker[1], func(r rune) bool {
+			return r == ',' || r == ' '
+		}) {
+			ids[id] = true
+		}
+	}
+
+	return ids
+}
+
+// withoutSkipped returns the watch entries whose id is not skipped.
+func withoutSkipped(watch []WatchConfig, skipped map[string]bool) []WatchConfig {
+	if len(skipped) == 0 {
+		return watch
+	}
+
+	result := []WatchConfig{}
+
+	for _, w := range watch {
+		if w.ID != "" && skipped[w.ID] {
+			log.Infof("Skipping watch entry %s as requested by the commit message", w.ID)
+			continue
+		}
+		result = append(result, w)
+	}
+
+	return result
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForceAllReason(t *testing.T) {
+	testCases := map[string]struct {
+		Config   ForceAllConfig
+		Env      map[string]string
+		Expected string
+	}{
+		"nothing configured": {
+			Config:   ForceAllConfig{},
+			Expected: "",
+		},
+		"commit message marker": {
+			Config:   ForceAllConfig{Message: "[ci all]"},
+			Env:      map[string]string{"BUILDKITE_MESSAGE": "chore: bump go [ci all]"},
+			Expected: "commit message contains [ci all]",
+		},
+		"commit message without marker": {
+			Config:   ForceAllConfig{Message: "[ci all]"},
+			Expected: "",
+		},
+		"env var": {
+			Config:   ForceAllConfig{Env: "FORCE_ALL"},
+			Env:      map[string]string{"FORCE_ALL": "true"},
+			Expected: "FORCE_ALL is set",
+		},
+		"env var set to false": {
+			Config:   ForceAllConfig{Env: "FORCE_ALL"},
+			Env:      map[string]string{"FORCE_ALL": "false"},
+			Expected: "",
+		},
+		"branch pattern": {
+			Config:   ForceAllConfig{Branches: []string{"main", "release/**"}},
+			Env:      map[string]string{"BUILDKITE_BRANCH": "release/v1/rc"},
+			Expected: "branch release/v1/rc matches release/**",
+		},
+		"other branch": {
+			Config:   ForceAllConfig{Branches: []string{"main", "release/**"}},
+			Expected: "",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			for key, value := range tc.Env {
+				t.Setenv(key, value)
+			}
+
+			got, err := forceAllReason(defaultAgent, tc.Config)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestForceAllReasonFromMetaData(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "get", "force-all", "--default", "").
+		AndWriteToStdout("true\n").
+		AndExitWith(0)
+
+	got, err := forceAllReason(defaultAgent, ForceAllConfig{MetaData: "force-all"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "meta-data force-all is set", got)
+
+	agent.CheckAndClose(t)
+}
+
+func TestForceAllReasonFromMetaDataFails(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "get", "force-all", "--default", "").
+		AndExitWith(1)
+
+	_, err := forceAllReason(defaultAgent, ForceAllConfig{MetaData: "force-all"})
+
+	assert.EqualError(t, err, "could not read meta-data force-all: command `buildkite-agent` failed: exit status 1")
+
+	agent.CheckAndClose(t)
+}
+
+func TestSkippedIDs(t *testing.T) {
+	testCases := map[string]struct {
+		Message  string
+		Expected map[string]bool
+	}{
+		"no marker": {
+			Message:  "fix: temp file not correctly deleted",
+			Expected: map[string]bool{},
+		},
+		"single id": {
+			Message:  "docs: typo [ci skip service-a]",
+			Expected: map[string]bool{"service-a": true},
+		},
+		"several ids and markers": {
+			Message:  "chore: [ci skip service-a, service-b]\n\n[ci skip service-c]",
+			Expected: map[string]bool{"service-a": true, "service-b": true, "service-c": true},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.Expected, skippedIDs(tc.Message))
+		})
+	}
+}
+
+func TestWithoutSkipped(t *testing.T) {
+	watch := []WatchConfig{
+		{ID: "service-a", Step: Step{Trigger: "service-a"}},
+		{ID: "service-b", Step: Step{Trigger: "service-b"}},
+		{Step: Step{Trigger: "service-c"}},
+	}
+
+	got := withoutSkipped(watch, map[string]bool{"service-a": true})
+
+	assert.Equal(t, []WatchConfig{watch[1], watch[2]}, got)
+}
+
+func TestUploadPipelineForcesAllSteps(t *testing.T) {
+	t.Setenv("BUILDKITE_MESSAGE", "chore: bump deps [ci all] [ci skip service-2]")
+
+	plugin := Plugin{
+		Diff:     "exit 1",
+		ForceAll: ForceAllConfig{Message: "[ci all]"},
+		Watch: []WatchConfig{
+			{
+				ID:    "service-1",
+				Paths: []string{"service-1/"},
+				Step:  Step{Trigger: "service-1"},
+			},
+			{
+				ID:    "service-2",
+				Paths: []string{"service-2/"},
+				Step:  Step{Trigger: "service-2"},
+			},
+			{
+				Default: true,
+				Step:    Step{Command: "echo default"},
+			},
+		},
+	}
+
+	var got []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "service-1"}}, got)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineSkipsWatchEntries(t *testing.T) {
+	t.Setenv("BUILDKITE_MESSAGE", "fix: shared code [ci skip service-2]")
+
+	plugin := Plugin{
+		Diff: "echo service-1/main.go service-2/main.go",
+		Unmatched: UnmatchedConfig{
+			Policy: unmatchedFail,
+		},
+		Watch: []WatchConfig{
+			{
+				ID:    "service-1",
+				Paths: []string{"service-1/"},
+				Step:  Step{Trigger: "service-1"},
+			},
+			{
+				ID:    "service-2",
+				Paths: []string{"service-2/"},
+				Step:  Step{Trigger: "service-2"},
+			},
+		},
+	}
+
+	var got []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{{Trigger: "service-1"}}, got)
+
+	agent.CheckAndClose(t)
+}
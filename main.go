@@ -1,6 +1,11 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
 	log "github.com/sirupsen/logrus"
 )
 
@@ -27,19 +32,30 @@ func main() {
 
 	log.Debugf("received plugin: \n%v", plugins)
 
-	plugin, err := initializePlugin(plugins)
+	instances, err := initializePlugins(plugins)
 	if err != nil {
-		log.Debug(err)
-		log.Fatal(err)
+		exit(err)
 	}
 
-	setupLogger(plugin.LogLevel)
+	setupLogger(instances[0].LogLevel)
 
 	if env("BUILDKITE_PLUGIN_MONOREPO_DIFF_BUILDKITE_PLUGIN_TEST_MODE", "false") == "true" {
 		return
 	}
 
-	if _, _, err = uploadPipeline(plugin, generatePipeline); err != nil {
-		log.Fatalf("+++ failed to upload pipeline: %v", err)
+	// Stop the commands in flight when the job is cancelled, as they run
+	// in their own process group and would not get the signal.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	interrupted = ctx
+
+	if err = uploadPipelines(instances, generatePipeline); err != nil {
+		exit(err)
 	}
 }
+
+// exit reports err and exits with the code matching the stage it happened in.
+func exit(err error) {
+	log.Errorf("+++ %s", describe(err))
+	os.Exit(exitCode(err))
+}
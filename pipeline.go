@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/bmatcuk/doublestar/v2"
 	log "github.com/sirupsen/logrus"
@@ -35,63 +39,481 @@ func (s Step) MarshalYAML() (interface{}, error) {
 }
 
 func (n PluginNotify) MarshalYAML() (interface{}, error) {
-	return n, nil
+	if n.Simple != "" {
+		return n.Simple, nil
+	}
+
+	type Alias PluginNotify
+	return (Alias)(n), nil
+}
+
+func (n StepNotify) MarshalYAML() (interface{}, error) {
+	if n.Simple != "" {
+		return n.Simple, nil
+	}
+
+	type Alias StepNotify
+	return (Alias)(n), nil
 }
 
+// unmatchedFilesEnv lists the changed files not covered by any watch entry
+const unmatchedFilesEnv = "MONOREPO_DIFF_UNMATCHED_FILES"
+
+// Special values of the output option
+const (
+	stdoutOutput         = "-"
+	artifactOutputPrefix = "artifact:"
+)
+
+// defaultRetryBackoff is the wait before the first upload retry
+const defaultRetryBackoff = 2 * time.Second
+
+// Modes of the default watch entries
+const (
+	defaultModeFallback = "fallback"
+	defaultModeAlways   = "always"
+)
+
+// Policies for a failing diff command
+const (
+	diffFailureFail           = "fail"
+	diffFailureTriggerAll     = "trigger_all"
+	diffFailureTriggerDefault = "trigger_default"
+	diffFailureSkip           = "skip"
+)
+
+// Formats the pipeline can be generated in
+const (
+	yamlFormat = "yaml"
+	jsonFormat = "json"
+)
+
 // PipelineGenerator generates pipeline file
 type PipelineGenerator func(steps []Step, plugin Plugin) (*os.File, bool, error)
 
-func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator) (string, []string, error) {
-	diffOutput, err := diff(plugin.Diff)
-	if err != nil {
-		log.Fatal(err)
-		return "", []string{}, err
+// uploadPipelines uploads the pipelines of the plugin instances. Instances
+// with merge set are uploaded together, after the other ones.
+func uploadPipelines(plugins []Plugin, generatePipeline PipelineGenerator) error {
+	var merged []Plugin
+	var plans []plannedSteps
+	steps := []Step{}
+
+	for i, plugin := range plugins {
+		if len(plugins) > 1 {
+			log.Infof("Running monorepo-diff instance %d", i)
+		}
+
+		if plugin.Merge {
+			planned, changes, _, err := planSteps(plugin)
+			if err != nil {
+				return instanceError(plugins, i, err)
+			}
+
+			merged = append(merged, plugin)
+			plans = append(plans, plannedSteps{steps: planned, changes: changes})
+			steps = append(steps, planned...)
+			continue
+		}
+
+		if _, _, err := uploadPipeline(plugin, generatePipeline); err != nil {
+			return instanceError(plugins, i, err)
+		}
 	}
 
-	if len(diffOutput) < 1 {
-		log.Info("No changes detected. Skipping pipeline upload.")
-		return "", []string{}, nil
+	if len(merged) == 0 {
+		return nil
 	}
 
-	log.Debug("Output from diff: \n" + strings.Join(diffOutput, "\n"))
+	if len(steps) == 0 {
+		log.Info("No steps to merge. Skipping pipeline upload.")
+		return nil
+	}
 
-	steps, err := stepsToTrigger(diffOutput, plugin.Watch)
-	if err != nil {
+	log.Infof("Uploading the steps of %d merged instances", len(merged))
+
+	if _, _, err := uploadSteps(mergedPlugin(merged), dedupSteps(steps), generatePipeline); err != nil {
+		return err
+	}
+
+	for i, plugin := range merged {
+		if err := recordMetaData(plugin, plans[i].changes, plans[i].steps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergedPlugin returns the plugin uploading the steps of the merged
+// instances: the first of them, with the notify and hooks of all of them.
+func mergedPlugin(merged []Plugin) Plugin {
+	plugin := merged[0]
+	plugin.Notify = nil
+	plugin.Hooks = nil
+
+	for _, p := range merged {
+		for _, notify := range p.Notify {
+			if !containsNotify(plugin.Notify, notify) {
+				plugin.Notify = append(plugin.Notify, notify)
+			}
+		}
+
+		for _, hook := range p.Hooks {
+			if !containsHook(plugin.Hooks, hook) {
+				plugin.Hooks = append(plugin.Hooks, hook)
+			}
+		}
+	}
+
+	return plugin
+}
+
+func containsNotify(notify []PluginNotify, n PluginNotify) bool {
+	for _, existing := range notify {
+		if reflect.DeepEqual(existing, n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsHook(hooks []HookConfig, h HookConfig) bool {
+	for _, existing := range hooks {
+		if existing == h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// plannedSteps are the steps planned by an instance, with the changes
+// they were planned from.
+type plannedSteps struct {
+	steps   []Step
+	changes changeSet
+}
+
+// instanceError adds the index of the instance to err when there are
+// several instances.
+func instanceError(plugins []Plugin, i int, err error) error {
+	if len(plugins) < 2 {
+		return err
+	}
+
+	var pluginErr *PluginError
+	if errors.As(err, &pluginErr) {
+		return &PluginError{Kind: pluginErr.Kind, Err: fmt.Errorf("instance %d: %v", i, pluginErr.Err)}
+	}
+
+	return fmt.Errorf("instance %d: %v", i, err)
+}
+
+func uploadPipeline(plugin Plugin, generatePipeline PipelineGenerator) (string, []string, error) {
+	steps, changes, ok, err := planSteps(plugin)
+	if err != nil || !ok {
 		return "", []string{}, err
 	}
 
-	pipeline, hasSteps, err := generatePipeline(steps, plugin)
-	defer os.Remove(pipeline.Name())
+	cmd, args, err := uploadSteps(plugin, steps, generatePipeline)
+	if err != nil {
+		return cmd, args, err
+	}
+
+	return cmd, args, recordMetaData(plugin, changes, steps)
+}
 
+// uploadSteps generates the pipeline of steps and uploads it with
+// the options of plugin.
+func uploadSteps(plugin Plugin, steps []Step, generatePipeline PipelineGenerator) (string, []string, error) {
+	pipeline, hasSteps, err := generatePipeline(steps, plugin)
 	if err != nil {
-		log.Error(err)
-		return "", []string{}, err
+		return "", []string{}, newError(generationError, err)
 	}
 
+	defer os.Remove(pipeline.Name())
+
 	if !hasSteps {
 		// Handle the case where no steps were provided
 		log.Info("No steps generated. Skipping pipeline upload.")
 		return "", []string{}, nil
 	}
 
-	cmd := "buildkite-agent"
+	if err := writeOutput(plugin.agent(), plugin.Output, pipeline.Name()); err != nil {
+		return "", []string{}, newError(generationError, err)
+	}
+
+	if plugin.SkipUpload {
+		log.Info("Pipeline upload is disabled. Skipping pipeline upload.")
+		return "", []string{}, nil
+	}
+
+	cmd := plugin.agent()
 	args := []string{"pipeline", "upload", pipeline.Name()}
 
 	if !plugin.Interpolation {
 		args = append(args, "--no-interpolation")
 	}
 
-	_, err = executeCommand("buildkite-agent", args)
+	if plugin.Replace {
+		args = append(args, "--replace")
+	}
+
+	if plugin.RejectSecrets {
+		args = append(args, "--reject-secrets")
+	}
+
+	if plugin.DryRun {
+		args = append(args, "--dry-run")
+	}
+
+	args = append(args, plugin.Signing.uploadArgs()...)
+
+	backoff := plugin.UploadRetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+
+	err = retry(plugin.UploadRetries+1, backoff, func() error {
+		ctx, cancel := contextWithTimeout(plugin.UploadTimeout)
+		defer cancel()
+
+		output, err := runCommand(ctx, cmd, args, plugin.UploadEnv)
+
+		// The agent prints the pipeline it would upload on a dry run. It is
+		// interpolated, so env values can't be redacted, and it is only
+		// logged at the debug level.
+		if err == nil && plugin.DryRun && plugin.PrintPipeline != printNone {
+			log.Debug("Dry run of the pipeline upload:")
+			for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+				log.Debug(line)
+			}
+		}
+
+		// A timed out upload may still have been applied, so it is only
+		// retried when it replaces the pipeline.
+		if err != nil && ctx.Err() != nil && !plugin.Replace {
+			return noRetry{err}
+		}
+
+		return err
+	})
+
+	return cmd, args, newError(uploadError, err)
+}
+
+// planSteps runs the diff and returns the steps to upload with the changes
+// they were planned from, or false if there is nothing to upload.
+func planSteps(plugin Plugin) ([]Step, changeSet, bool, error) {
+	watch := withoutSkipped(plugin.Watch, skippedIDs(env("BUILDKITE_MESSAGE", "")))
+	watch = withMatchingRef(watch)
+
+	reason, err := forceAllReason(plugin.agent(), plugin.ForceAll)
+	if err != nil {
+		return nil, changeSet{}, false, newError(matchError, err)
+	}
+
+	if reason != "" {
+		log.Infof("Triggering every watch entry: %s", reason)
+
+		var changes changeSet
+		if plugin.SetMetaData {
+			changes = newChangeSet(plugin, []string{})
+		}
+
+		watch, err := withMatchingCondition(watch, []string{})
+		if err != nil {
+			return nil, changes, false, newError(matchError, err)
+		}
+
+		steps := allSteps(watch)
+		return steps, changes, true, nil
+	}
+
+	if err := deepen(plugin); err != nil {
+		log.Warnf("%v, the diff may fail", err)
+	}
+
+	diffOutput, diffErr := diffWithTimeout(plugin.Diff, plugin.DiffTimeout)
+
+	var changes changeSet
+	if plugin.ExposeChanges || plugin.SetMetaData {
+		changes = newChangeSet(plugin, diffOutput)
+	}
+
+	if diffErr != nil {
+		watch, err := withMatchingCondition(watch, []string{})
+		if err != nil {
+			return nil, changes, false, newError(matchError, err)
+		}
+
+		steps, err := diffFailureSteps(plugin, watch, diffErr)
+		if err != nil || steps == nil {
+			return nil, changes, false, err
+		}
+
+		return steps, changes, true, nil
+	}
+
+	if len(diffOutput) < 1 {
+		log.Info("No changes detected. Skipping pipeline upload.")
+		return nil, changes, false, recordMetaData(plugin, changes, []Step{})
+	}
+
+	log.Debug("Output from diff: \n" + strings.Join(diffOutput, "\n"))
+
+	unmatched, err := unmatchedFiles(diffOutput, plugin.Watch)
+	if err != nil {
+		return nil, changes, false, newError(matchError, err)
+	}
+
+	if plugin.ExposeChanges {
+		watch, err = withChangesEnv(plugin, watch, changes)
+		if err != nil {
+			return nil, changes, false, newError(generationError, err)
+		}
+	}
+
+	if len(unmatched) > 0 {
+		watch = withDefaultEnv(watch, unmatchedEnv(unmatched, plugin.Interpolation))
+	}
+
+	watch, err = withMatchingCondition(watch, diffOutput)
+	if err != nil {
+		return nil, changes, false, newError(matchError, err)
+	}
+
+	steps, err := stepsToTrigger(diffOutput, watch)
+	if err != nil {
+		return nil, changes, false, newError(matchError, err)
+	}
+
+	steps, err = applyUnmatched(plugin.agent(), plugin.Unmatched, unmatched, steps, plugin.Interpolation)
+	if err != nil {
+		return nil, changes, false, newError(matchError, err)
+	}
+
+	return steps, changes, true, nil
+}
+
+// diffFailureSteps applies the on_diff_failure policy to a failed diff,
+// returning the steps to upload, or nil if the upload should be skipped.
+func diffFailureSteps(plugin Plugin, watch []WatchConfig, diffErr error) ([]Step, error) {
+	policy := plugin.OnDiffFailure
+	if policy == "" {
+		policy = diffFailureFail
+	}
+
+	var steps []Step
+
+	switch policy {
+	case diffFailureTriggerAll:
+		steps = allSteps(watch)
+	case diffFailureTriggerDefault:
+		defaults, err := stepsToTrigger([]string{}, watch)
+		if err != nil {
+			return nil, newError(matchError, err)
+		}
+		steps = defaults
+	}
+
+	summary := fmt.Sprintf("diff command failed, applying on_diff_failure policy %s", policy)
+	log.Warnf("%s: %v", summary, diffErr)
+
+	style := "warning"
+	if policy == diffFailureFail {
+		style = "error"
+	}
+
+	body := fmt.Sprintf("**monorepo-diff: %s**\n\n```\n%v\n```\n", summary, diffErr)
+	if err := annotate(plugin.agent(), body, style, "monorepo-diff-diff-failure"); err != nil {
+		log.Warnf("could not annotate diff failure: %v", err)
+	}
+
+	if policy == diffFailureFail {
+		return nil, newError(diffError, diffErr)
+	}
 
-	return cmd, args, err
+	return steps, nil
+}
+
+// allSteps returns the steps of every watch entry but the fallback
+// default ones.
+func allSteps(watch []WatchConfig) []Step {
+	steps := []Step{}
+
+	for _, w := range watch {
+		if w.Default == nil || w.DefaultMode == defaultModeAlways {
+			steps = append(steps, w.Step)
+		}
+	}
+
+	return dedupSteps(steps)
+}
+
+// recordMetaData writes the change set and the steps to the build
+// meta-data when set_meta_data is enabled, except for dry runs.
+func recordMetaData(plugin Plugin, changes changeSet, steps []Step) error {
+	if !plugin.SetMetaData || plugin.DryRun {
+		return nil
+	}
+
+	return newError(uploadError, writeMetaData(plugin, changes, steps))
+}
+
+// writeOutput copies the generated pipeline to a file, to stdout when
+// output is "-", or to a file uploaded as a build artifact when output
+// starts with "artifact:".
+func writeOutput(agent string, output string, pipeline string) error {
+	if output == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(pipeline)
+	if err != nil {
+		return fmt.Errorf("could not read generated pipeline: %v", err)
+	}
+
+	if output == stdoutOutput {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	path := strings.TrimPrefix(output, artifactOutputPrefix)
+
+	if err = os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("could not write pipeline to %s: %v", path, err)
+	}
+
+	log.Infof("Pipeline written to %s", path)
+
+	if strings.HasPrefix(output, artifactOutputPrefix) {
+		if _, err = executeCommand(agent, []string{"artifact", "upload", path}); err != nil {
+			return fmt.Errorf("could not upload pipeline artifact %s: %v", path, err)
+		}
+	}
+
+	return nil
 }
 
 func diff(command string) ([]string, error) {
+	return diffWithTimeout(command, 0)
+}
+
+// diffWithTimeout runs the diff command, killing it if it takes longer
+// than timeout. A zero timeout means no timeout.
+func diffWithTimeout(command string, timeout time.Duration) ([]string, error) {
 	log.Infof("Running diff command: %s", command)
 
-	output, err := executeCommand(
+	ctx, cancel := contextWithTimeout(timeout)
+	defer cancel()
+
+	output, err := runCommand(
+		ctx,
 		env("SHELL", "bash"),
 		[]string{"-c", strings.Replace(command, "\n", " ", -1)},
+		nil,
 	)
 	if err != nil {
 		return nil, fmt.Errorf("diff command failed: %v", err)
@@ -102,47 +524,194 @@ func diff(command string) ([]string, error) {
 
 func stepsToTrigger(files []string, watch []WatchConfig) ([]Step, error) {
 	steps := []Step{}
-	var defaultStep *Step
+	fallback := []Step{}
+	always := []Step{}
 
 	for _, w := range watch {
 		if w.Default != nil {
-			defaultStep = &w.Step
+			if w.DefaultMode == defaultModeAlways {
+				always = append(always, w.Step)
+			} else {
+				fallback = append(fallback, w.Step)
+			}
 			continue
 		}
-		for _, p := range w.Paths {
-			for _, f := range files {
-				match, err := matchPath(p, f)
+		for _, f := range files {
+			match, err := matchWatch(w, f)
+			if err != nil {
+				return nil, err
+			}
+
+			if match {
+				steps = append(steps, w.Step)
+				break
+			}
+		}
+	}
+
+	if len(steps) == 0 {
+		steps = append(steps, fallback...)
+	}
+
+	return dedupSteps(append(steps, always...)), nil
+}
+
+// matchWatch checks if the file f is matched by one of the paths
+// of the watch entry w and not excluded by its skip paths.
+func matchWatch(w WatchConfig, f string) (bool, error) {
+	_, match, err := matchingPath(w, f)
+	return match, err
+}
+
+// matchingPath returns the path of the watch entry w that matches the file f,
+// unless f is excluded by one of its skip paths.
+func matchingPath(w WatchConfig, f string) (string, bool, error) {
+	for _, sp := range w.SkipPaths {
+		skip, err := matchPath(sp, f)
+		if err != nil {
+			return "", false, err
+		}
 
-				skip := false
-				for _, sp := range w.SkipPaths {
-					skipMatch, errSkip := matchPath(sp, f)
+		if skip {
+			return "", false, nil
+		}
+	}
 
-					if errSkip != nil {
-						return nil, errSkip
-					}
+	for _, p := range w.Paths {
+		match, err := matchPath(p, f)
+		if err != nil {
+			return "", false, err
+		}
 
-					if skipMatch {
-						skip = true
-					}
-				}
+		if match {
+			return p, true, nil
+		}
+	}
+
+	return "", false, nil
+}
 
-				if err != nil {
-					return nil, err
-				}
+// unmatchedFiles returns the files that are not covered by any watch entry.
+func unmatchedFiles(files []string, watch []WatchConfig) ([]string, error) {
+	unmatched := []string{}
+
+	for _, f := range files {
+		covered := false
+		for _, w := range watch {
+			if w.Default != nil {
+				continue
+			}
 
-				if match && !skip {
-					steps = append(steps, w.Step)
-					break
-				}
+			match, err := matchWatch(w, f)
+			if err != nil {
+				return nil, err
+			}
+
+			if match {
+				covered = true
+				break
 			}
 		}
+
+		if !covered {
+			unmatched = append(unmatched, f)
+		}
+	}
+
+	return unmatched, nil
+}
+
+// applyUnmatched enforces the unmatched policy once the steps to trigger
+// are known, returning the steps to upload.
+func applyUnmatched(agent string, config UnmatchedConfig, files []string, steps []Step, interpolation bool) ([]Step, error) {
+	if len(files) == 0 {
+		return steps, nil
+	}
+
+	summary := fmt.Sprintf("%d changed file(s) not covered by any watch entry", len(files))
+
+	switch config.Policy {
+	case unmatchedWarn:
+		log.Warnf("%s:\n%s", summary, strings.Join(files, "\n"))
+		annotateUnmatched(agent, "warning", summary, files)
+	case unmatchedFail:
+		log.Errorf("%s:\n%s", summary, strings.Join(files, "\n"))
+		annotateUnmatched(agent, "error", summary, files)
+		return nil, errors.New(summary)
+	case unmatchedTrigger:
+		log.Infof("%s, triggering unmatched step:\n%s", summary, strings.Join(files, "\n"))
+		step := withEnv(*config.Step, unmatchedEnv(files, interpolation))
+		steps = dedupSteps(append(steps, step))
+	default:
+		log.Debugf("%s:\n%s", summary, strings.Join(files, "\n"))
+	}
+
+	return steps, nil
+}
+
+// unmatchedEnv returns the env listing the unmatched files, escaped so
+// that paths containing $ are not interpolated on upload.
+func unmatchedEnv(files []string, interpolation bool) map[string]string {
+	list := strings.Join(files, " ")
+	if interpolation {
+		list = escapeInterpolation(list)
+	}
+
+	return map[string]string{unmatchedFilesEnv: list}
+}
+
+func annotateUnmatched(agent string, style string, summary string, files []string) {
+	var body strings.Builder
+
+	fmt.Fprintf(&body, "**monorepo-diff: %s**\n\n", summary)
+	for _, f := range files {
+		fmt.Fprintf(&body, "- `%s`\n", f)
+	}
+
+	if err := annotate(agent, body.String(), style, "monorepo-diff-unmatched"); err != nil {
+		log.Warnf("could not annotate unmatched files: %v", err)
+	}
+}
+
+// withDefaultEnv returns a copy of watch where the default entries
+// have vars added to their env.
+func withDefaultEnv(watch []WatchConfig, vars map[string]string) []WatchConfig {
+	result := make([]WatchConfig, len(watch))
+
+	for i, w := range watch {
+		if w.Default != nil {
+			w.Step = withEnv(w.Step, vars)
+		}
+		result[i] = w
 	}
 
-	if len(steps) == 0 && defaultStep != nil {
-		steps = append(steps, *defaultStep)
+	return result
+}
+
+// withEnv returns a copy of step with vars added to its env, or to its
+// build env for trigger steps.
+func withEnv(step Step, vars map[string]string) Step {
+	if step.Command != nil || step.Commands != nil {
+		step.Env = mergeEnv(step.Env, vars)
+	} else if step.Trigger != "" {
+		step.Build.Env = mergeEnv(step.Build.Env, vars)
 	}
 
-	return dedupSteps(steps), nil
+	return step
+}
+
+func mergeEnv(base map[string]string, vars map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(vars))
+
+	for key, value := range base {
+		merged[key] = value
+	}
+
+	for key, value := range vars {
+		merged[key] = value
+	}
+
+	return merged
 }
 
 // matchPath checks if the file f matches the path p.
@@ -165,6 +734,24 @@ func matchPath(p string, f string) (bool, error) {
 	return false, nil
 }
 
+// stepName returns a human readable name for the step.
+func stepName(s Step) string {
+	switch {
+	case s.Label != "":
+		return s.Label
+	case s.Trigger != "":
+		return s.Trigger
+	case s.Group != "":
+		return s.Group
+	}
+
+	if command, ok := isString(s.Command); ok {
+		return command
+	}
+
+	return ""
+}
+
 func dedupSteps(steps []Step) []Step {
 	unique := []Step{}
 	for _, p := range steps {
@@ -185,11 +772,42 @@ func dedupSteps(steps []Step) []Step {
 }
 
 func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
+	hooks := make([]Step, len(plugin.Hooks))
+	for i, cmd := range plugin.Hooks {
+		hooks[i] = Step{Command: cmd.Command}
+	}
+
 	tmp, err := os.CreateTemp(os.TempDir(), "bmrd-")
 	if err != nil {
 		return nil, false, fmt.Errorf("could not create temporary pipeline file: %v", err)
 	}
 
+	data, err := marshalPipeline(steps, hooks, plugin)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not serialize the pipeline: %v", err)
+	}
+
+	// Disable logging in context of go tests, or when the
+	// pipeline itself is written to stdout.
+	if env("TEST_MODE", "") != "true" && plugin.Output != stdoutOutput {
+		printPipeline(steps, hooks, plugin)
+	}
+
+	if err = os.WriteFile(tmp.Name(), data, 0o644); err != nil {
+		return nil, false, fmt.Errorf("could not write step to temporary file: %v", err)
+	}
+
+	// Returns the temporary file and a boolean indicating whether or not the pipeline has steps
+	if len(steps) == 0 && !plugin.Wait && len(hooks) == 0 {
+		return tmp, false, nil
+	} else {
+		return tmp, true, nil
+	}
+}
+
+// marshalPipeline serializes the pipeline made of steps, followed by a
+// wait step and hooks if any, in the format of plugin.
+func marshalPipeline(steps []Step, hooks []Step, plugin Plugin) ([]byte, error) {
 	yamlSteps := make([]yaml.Marshaler, len(steps))
 
 	for i, step := range steps {
@@ -200,8 +818,8 @@ func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 		yamlSteps = append(yamlSteps, WaitStep{})
 	}
 
-	for _, cmd := range plugin.Hooks {
-		yamlSteps = append(yamlSteps, Step{Command: cmd.Command})
+	for _, hook := range hooks {
+		yamlSteps = append(yamlSteps, hook)
 	}
 
 	yamlNotify := make([]yaml.Marshaler, len(plugin.Notify))
@@ -219,22 +837,54 @@ func generatePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 
 	data, err := yaml.Marshal(&pipeline)
 	if err != nil {
-		return nil, false, fmt.Errorf("could not serialize the pipeline: %v", err)
+		return nil, err
 	}
 
-	// Disable logging in context of go tests.
-	if env("TEST_MODE", "") != "true" {
-		fmt.Printf("Generated Pipeline:\n%s\n", string(data))
+	if plugin.Format == jsonFormat {
+		return yamlToJSON(data)
 	}
 
-	if err = os.WriteFile(tmp.Name(), data, 0o644); err != nil {
-		return nil, false, fmt.Errorf("could not write step to temporary file: %v", err)
+	return data, nil
+}
+
+// yamlToJSON converts a YAML document to JSON. Going through YAML keeps
+// the custom YAML marshalling of steps, so both formats describe the same
+// pipeline.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
 	}
 
-	// Returns the temporary file and a boolean indicating whether or not the pipeline has steps
-	if len(yamlSteps) == 0 {
-		return tmp, false, nil
-	} else {
-		return tmp, true, nil
+	var out bytes.Buffer
+
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(jsonValue(doc)); err != nil {
+		return nil, err
 	}
+
+	return out.Bytes(), nil
+}
+
+// jsonValue converts the generic maps produced by the YAML decoder,
+// which have interface keys, into maps that can be encoded as JSON.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[fmt.Sprint(key)] = jsonValue(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonValue(value)
+		}
+		return v
+	}
+
+	return v
 }
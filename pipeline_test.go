@@ -1,15 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/buildkite/bintest"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
 )
 
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
 func mockGeneratePipeline(steps []Step, plugin Plugin) (*os.File, bool, error) {
 	mockFile, _ := os.Create("pipeline.txt")
 	defer mockFile.Close()
@@ -67,6 +76,210 @@ func TestUploadPipelineCallsBuildkiteAgentCommandWithInterpolation(t *testing.T)
 	agent.CheckAndClose(t)
 }
 
+func TestUploadPipelineCallsBuildkiteAgentCommandWithSigning(t *testing.T) {
+	plugin := Plugin{
+		Diff:          "echo ./foo-service",
+		Interpolation: true,
+		Signing:       SigningConfig{JWKSFile: "jwks.json", JWKSKeyID: "my-key"},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--jwks-file", "jwks.json", "--jwks-key-id", "my-key").
+		AndExitWith(0)
+
+	_, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt", "--jwks-file", "jwks.json", "--jwks-key-id", "my-key"}, args)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineWithUploadOptions(t *testing.T) {
+	dir := t.TempDir()
+	agent := filepath.Join(dir, "custom-agent")
+	calls := filepath.Join(dir, "calls")
+
+	script := "#!/bin/sh\necho \"$BUILDKITE_AGENT_DEBUG $*\" >> " + calls + "\n"
+	require.NoError(t, os.WriteFile(agent, []byte(script), 0o755))
+
+	plugin := Plugin{
+		Diff:          "echo ./foo-service",
+		Interpolation: true,
+		Replace:       true,
+		RejectSecrets: true,
+		AgentPath:     agent,
+		UploadEnv:     map[string]string{"BUILDKITE_AGENT_DEBUG": "true"},
+	}
+
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, agent, cmd)
+	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt", "--replace", "--reject-secrets"}, args)
+	assert.NoError(t, err)
+
+	got, err := os.ReadFile(calls)
+	require.NoError(t, err)
+	assert.Equal(t, "true pipeline upload pipeline.txt --replace --reject-secrets\n", string(got))
+}
+
+func TestUploadPipelineWithDryRun(t *testing.T) {
+	plugin := Plugin{Diff: "echo ./foo-service", Interpolation: true, DryRun: true}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--dry-run").
+		AndExitWith(0)
+
+	_, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, []string{"pipeline", "upload", "pipeline.txt", "--dry-run"}, args)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineLogsTheDryRunOutput(t *testing.T) {
+	testCases := map[string]struct {
+		Level         log.Level
+		PrintPipeline string
+		Logged        bool
+	}{
+		"info":                {Level: log.InfoLevel},
+		"debug":               {Level: log.DebugLevel, Logged: true},
+		"debug, printed none": {Level: log.DebugLevel, PrintPipeline: printNone},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			plugin := Plugin{Diff: "echo ./foo-service", Interpolation: true, DryRun: true, PrintPipeline: tc.PrintPipeline}
+
+			fakeRunCommand(t, func(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+				if command != defaultAgent {
+					return runExternalCommand(ctx, command, args, env)
+				}
+
+				return "steps:\n- command: make\n  env:\n    TOKEN: t0k3n\n", nil
+			})
+
+			level := log.GetLevel()
+			log.SetLevel(tc.Level)
+			t.Cleanup(func() { log.SetLevel(level) })
+
+			buf := captureLog(t)
+
+			_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+			assert.NoError(t, err)
+
+			if tc.Logged {
+				assert.Contains(t, buf.String(), "Dry run of the pipeline upload:")
+				assert.Contains(t, buf.String(), "- command: make")
+			} else {
+				assert.NotContains(t, buf.String(), "t0k3n")
+			}
+		})
+	}
+}
+
+func TestUploadPipelineRetriesUpload(t *testing.T) {
+	plugin := Plugin{
+		Diff:               "echo ./foo-service",
+		Interpolation:      true,
+		UploadRetries:      2,
+		UploadRetryBackoff: time.Millisecond,
+		UploadTimeout:      time.Minute,
+	}
+
+	uploads := 0
+	fakeRunCommand(t, func(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+		if command != defaultAgent {
+			return runExternalCommand(ctx, command, args, env)
+		}
+
+		_, hasDeadline := ctx.Deadline()
+		assert.True(t, hasDeadline)
+
+		uploads++
+		if uploads < 3 {
+			return "", errors.New("agent API error")
+		}
+		return "", nil
+	})
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, uploads)
+}
+
+func TestUploadPipelineFailsAfterRetries(t *testing.T) {
+	plugin := Plugin{
+		Diff:               "echo ./foo-service",
+		UploadRetries:      1,
+		UploadRetryBackoff: time.Millisecond,
+	}
+
+	uploads := 0
+	fakeRunCommand(t, func(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+		if command != defaultAgent {
+			return runExternalCommand(ctx, command, args, env)
+		}
+
+		uploads++
+		return "", errors.New("agent API error")
+	})
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.EqualError(t, err, "agent API error")
+	assert.Equal(t, 2, uploads)
+}
+
+func TestUploadPipelineDoesNotRetryATimedOutUpload(t *testing.T) {
+	testCases := map[string]struct {
+		Replace bool
+		Uploads int
+	}{
+		"without replace": {Replace: false, Uploads: 1},
+		"with replace":    {Replace: true, Uploads: 2},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			plugin := Plugin{
+				Diff:               "echo ./foo-service",
+				Replace:            tc.Replace,
+				UploadRetries:      1,
+				UploadRetryBackoff: time.Millisecond,
+				UploadTimeout:      10 * time.Millisecond,
+			}
+
+			uploads := 0
+			fakeRunCommand(t, func(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+				if command != defaultAgent {
+					return runExternalCommand(ctx, command, args, env)
+				}
+
+				uploads++
+				<-ctx.Done()
+				return "", commandError(command, ctx.Err(), "")
+			})
+
+			_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+			assert.EqualError(t, err, "command `buildkite-agent` timed out")
+			assert.Equal(t, tc.Uploads, uploads)
+		})
+	}
+}
+
+func TestDiffWithTimeout(t *testing.T) {
+	_, err := diffWithTimeout("sleep 10", 100*time.Millisecond)
+
+	assert.EqualError(t, err, "diff command failed: command `"+env("SHELL", "bash")+"` timed out")
+}
+
 func TestUploadPipelineCancelsIfThereIsNoDiffOutput(t *testing.T) {
 	plugin := Plugin{Diff: "echo"}
 	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
@@ -76,6 +289,119 @@ func TestUploadPipelineCancelsIfThereIsNoDiffOutput(t *testing.T) {
 	assert.Equal(t, nil, err)
 }
 
+func TestUploadPipelineReturnsDiffError(t *testing.T) {
+	plugin := Plugin{Diff: "echo oops >&2; exit 1"}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("annotate", bintest.MatchAny(), "--style", "error", "--context", "monorepo-diff-diff-failure").
+		AndExitWith(0)
+
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, "", cmd)
+	assert.Equal(t, []string{}, args)
+	assert.EqualError(t, err, "diff command failed: command `"+env("SHELL", "bash")+"` failed: exit status 1: oops")
+	assert.Equal(t, 3, exitCode(err))
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineOnDiffFailure(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			Paths: []string{"service-1/"},
+			Step:  Step{Trigger: "service-1"},
+		},
+		{
+			Paths: []string{"service-2/"},
+			Step:  Step{Trigger: "service-2"},
+		},
+		{
+			Paths: []string{"service-3/"},
+			Step:  Step{Trigger: "service-1"},
+		},
+		{
+			Default: true,
+			Step:    Step{Command: "echo default"},
+		},
+	}
+
+	testCases := map[string]struct {
+		Policy   string
+		Expected []Step
+	}{
+		"trigger_all": {
+			Policy:   diffFailureTriggerAll,
+			Expected: []Step{{Trigger: "service-1"}, {Trigger: "service-2"}},
+		},
+		"trigger_default": {
+			Policy:   diffFailureTriggerDefault,
+			Expected: []Step{{Command: "echo default"}},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			plugin := Plugin{
+				Diff:          "exit 1",
+				Interpolation: true,
+				OnDiffFailure: tc.Policy,
+				Watch:         watch,
+			}
+
+			var got []Step
+			generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+				got = steps
+				return mockGeneratePipeline(steps, plugin)
+			}
+
+			agent := mockBuildkiteAgent(t)
+			agent.
+				Expect("annotate", bintest.MatchAny(), "--style", "warning", "--context", "monorepo-diff-diff-failure").
+				AndExitWith(0)
+			agent.
+				Expect("pipeline", "upload", "pipeline.txt").
+				AndExitWith(0)
+
+			_, _, err := uploadPipeline(plugin, generator)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+
+			agent.CheckAndClose(t)
+		})
+	}
+}
+
+func TestUploadPipelineSkipsOnDiffFailure(t *testing.T) {
+	plugin := Plugin{Diff: "exit 1", OnDiffFailure: diffFailureSkip}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("annotate", bintest.MatchAny(), "--style", "warning", "--context", "monorepo-diff-diff-failure").
+		AndExitWith(1)
+
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, "", cmd)
+	assert.Equal(t, []string{}, args)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineReturnsGenerationError(t *testing.T) {
+	plugin := Plugin{Diff: "echo ./foo-service"}
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		return nil, false, errors.New("could not serialize the pipeline")
+	}
+
+	_, _, err := uploadPipeline(plugin, generator)
+
+	assert.EqualError(t, err, "could not serialize the pipeline")
+	assert.Equal(t, 5, exitCode(err))
+}
+
 func TestUploadPipelineWithEmptyGeneratedPipeline(t *testing.T) {
 	plugin := Plugin{Diff: "echo ./bar-service"}
 	cmd, args, err := uploadPipeline(plugin, generatePipeline)
@@ -85,6 +411,144 @@ func TestUploadPipelineWithEmptyGeneratedPipeline(t *testing.T) {
 	assert.Equal(t, nil, err)
 }
 
+func TestUploadPipelineSetsMetaData(t *testing.T) {
+	plugin := Plugin{
+		Diff:          "echo foo-service/main.go",
+		Interpolation: true,
+		SetMetaData:   true,
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"foo-service/"},
+				Step:  Step{Trigger: "foo-service"},
+			},
+		},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("meta-data", "set", changedFilesKey, "foo-service/main.go").
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", triggeredKey, "foo-service").
+		AndExitWith(0)
+	agent.
+		Expect("meta-data", "set", headCommitKey, "123").
+		AndExitWith(0)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineSetsNoMetaDataWhenTheUploadFails(t *testing.T) {
+	plugin := Plugin{
+		Diff:          "echo foo-service/main.go",
+		Interpolation: true,
+		SetMetaData:   true,
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"foo-service/"},
+				Step:  Step{Trigger: "foo-service"},
+			},
+		},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt").
+		AndExitWith(1)
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.Error(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineSetsNoMetaDataOnDryRun(t *testing.T) {
+	plugin := Plugin{
+		Diff:          "echo foo-service/main.go",
+		Interpolation: true,
+		SetMetaData:   true,
+		DryRun:        true,
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"foo-service/"},
+				Step:  Step{Trigger: "foo-service"},
+			},
+		},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--dry-run").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, mockGeneratePipeline)
+	assert.NoError(t, err)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineWithUploadDisabled(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "pipeline.yml")
+	plugin := Plugin{Diff: "echo ./foo-service", Output: output, SkipUpload: true}
+
+	agent := mockBuildkiteAgent(t)
+
+	cmd, args, err := uploadPipeline(plugin, mockGeneratePipeline)
+
+	assert.Equal(t, "", cmd)
+	assert.Equal(t, []string{}, args)
+	assert.NoError(t, err)
+	assert.FileExists(t, output)
+
+	agent.CheckAndClose(t)
+}
+
+func TestWriteOutput(t *testing.T) {
+	pipeline := filepath.Join(t.TempDir(), "generated.yml")
+	require.NoError(t, os.WriteFile(pipeline, []byte("steps: []\n"), 0o644))
+
+	t.Run("file", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "pipeline.yml")
+
+		err := writeOutput(defaultAgent, output, pipeline)
+		require.NoError(t, err)
+
+		got, err := os.ReadFile(output)
+		require.NoError(t, err)
+		assert.Equal(t, "steps: []\n", string(got))
+	})
+
+	t.Run("artifact", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "pipeline.yml")
+
+		agent := mockBuildkiteAgent(t)
+		agent.
+			Expect("artifact", "upload", output).
+			AndExitWith(0)
+
+		err := writeOutput(defaultAgent, artifactOutputPrefix+output, pipeline)
+		require.NoError(t, err)
+		assert.FileExists(t, output)
+
+		agent.CheckAndClose(t)
+	})
+
+	t.Run("none", func(t *testing.T) {
+		assert.NoError(t, writeOutput(defaultAgent, "", pipeline))
+	})
+
+	t.Run("missing directory", func(t *testing.T) {
+		output := filepath.Join(t.TempDir(), "missing", "pipeline.yml")
+		assert.Error(t, writeOutput(defaultAgent, output, pipeline))
+	})
+}
+
 func TestDiff(t *testing.T) {
 	want := []string{
 		"services/foo/serverless.yml",
@@ -113,6 +577,14 @@ func TestDiffWithSubshell(t *testing.T) {
 	assert.Equal(t, want, got)
 }
 
+func TestStepName(t *testing.T) {
+	assert.Equal(t, "label", stepName(Step{Label: "label", Trigger: "trigger"}))
+	assert.Equal(t, "trigger", stepName(Step{Trigger: "trigger"}))
+	assert.Equal(t, "group", stepName(Step{Group: "group", Command: "echo group"}))
+	assert.Equal(t, "echo hello", stepName(Step{Command: "echo hello"}))
+	assert.Equal(t, "", stepName(Step{Commands: []string{"echo hello"}}))
+}
+
 func TestPipelinesToTriggerGetsListOfPipelines(t *testing.T) {
 	want := []string{"service-1", "service-2", "service-4"}
 
@@ -285,6 +757,78 @@ func TestPipelinesStepsToTrigger(t *testing.T) {
 				{Command: "buildkite-agent pipeline upload other_tests.yml"},
 			},
 		},
+		"multiple default configurations": {
+			ChangedFiles: []string{
+				"unmatched/file.txt",
+			},
+			WatchConfigs: []WatchConfig{
+				{
+					Paths: []string{"app/"},
+					Step:  Step{Trigger: "app-deploy"},
+				},
+				{
+					Default: true,
+					Step:    Step{Command: "make smoke-test"},
+				},
+				{
+					Default: true,
+					Step:    Step{Command: "make lint"},
+				},
+			},
+			Expected: []Step{
+				{Command: "make smoke-test"},
+				{Command: "make lint"},
+			},
+		},
+		"always default configuration": {
+			ChangedFiles: []string{
+				"app/main.go",
+			},
+			WatchConfigs: []WatchConfig{
+				{
+					Default:     true,
+					DefaultMode: defaultModeAlways,
+					Step:        Step{Command: "make security-scan"},
+				},
+				{
+					Paths: []string{"app/"},
+					Step:  Step{Trigger: "app-deploy"},
+				},
+				{
+					Default: true,
+					Step:    Step{Command: "make smoke-test"},
+				},
+			},
+			Expected: []Step{
+				{Trigger: "app-deploy"},
+				{Command: "make security-scan"},
+			},
+		},
+		"always and fallback default configurations": {
+			ChangedFiles: []string{
+				"unmatched/file.txt",
+			},
+			WatchConfigs: []WatchConfig{
+				{
+					Default:     true,
+					DefaultMode: defaultModeAlways,
+					Step:        Step{Command: "make security-scan"},
+				},
+				{
+					Paths: []string{"app/"},
+					Step:  Step{Trigger: "app-deploy"},
+				},
+				{
+					Default:     true,
+					DefaultMode: defaultModeFallback,
+					Step:        Step{Command: "make smoke-test"},
+				},
+			},
+			Expected: []Step{
+				{Command: "make smoke-test"},
+				{Command: "make security-scan"},
+			},
+		},
 		"skips service-2": {
 			ChangedFiles: []string{
 				"watch-path/text.txt",
@@ -386,6 +930,174 @@ func TestPipelinesStepsToTrigger(t *testing.T) {
 	}
 }
 
+func TestUnmatchedFiles(t *testing.T) {
+	watch := []WatchConfig{
+		{
+			Paths: []string{"service-1/"},
+			Step:  Step{Trigger: "service-1"},
+		},
+		{
+			Paths:     []string{"service-2/"},
+			SkipPaths: []string{"service-2/docs/"},
+			Step:      Step{Trigger: "service-2"},
+		},
+		{
+			Default: true,
+			Step:    Step{Command: "echo default"},
+		},
+	}
+
+	changedFiles := []string{
+		"service-1/main.go",
+		"service-2/main.go",
+		"service-2/docs/README.md",
+		"README.md",
+	}
+
+	got, err := unmatchedFiles(changedFiles, watch)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"service-2/docs/README.md", "README.md"}, got)
+}
+
+func TestApplyUnmatched(t *testing.T) {
+	steps := []Step{{Trigger: "service-1"}}
+	files := []string{"README.md", "docs/index.md"}
+
+	testCases := map[string]struct {
+		Config   UnmatchedConfig
+		Files    []string
+		Expected []Step
+	}{
+		"ignore": {
+			Config:   UnmatchedConfig{Policy: unmatchedIgnore},
+			Files:    files,
+			Expected: steps,
+		},
+		"unset": {
+			Config:   UnmatchedConfig{},
+			Files:    files,
+			Expected: steps,
+		},
+		"trigger": {
+			Config: UnmatchedConfig{Policy: unmatchedTrigger, Step: &Step{Command: "echo unmatched"}},
+			Files:  files,
+			Expected: []Step{
+				{Trigger: "service-1"},
+				{
+					Command: "echo unmatched",
+					Env:     map[string]string{unmatchedFilesEnv: "README.md docs/index.md"},
+				},
+			},
+		},
+		"trigger without unmatched files": {
+			Config:   UnmatchedConfig{Policy: unmatchedTrigger, Step: &Step{Command: "echo unmatched"}},
+			Files:    []string{},
+			Expected: steps,
+		},
+		"fail without unmatched files": {
+			Config:   UnmatchedConfig{Policy: unmatchedFail},
+			Files:    []string{},
+			Expected: steps,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := applyUnmatched(defaultAgent, tc.Config, tc.Files, steps, false)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestApplyUnmatchedWarns(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("annotate", bintest.MatchAny(), "--style", "warning", "--context", "monorepo-diff-unmatched").
+		AndExitWith(0)
+
+	steps := []Step{{Trigger: "service-1"}}
+	got, err := applyUnmatched(defaultAgent, UnmatchedConfig{Policy: unmatchedWarn}, []string{"README.md"}, steps, false)
+
+	assert.NoError(t, err)
+	assert.Equal(t, steps, got)
+
+	agent.CheckAndClose(t)
+}
+
+func TestApplyUnmatchedFails(t *testing.T) {
+	agent := mockBuildkiteAgent(t)
+
+	agent.
+		Expect("annotate", bintest.MatchAny(), "--style", "error", "--context", "monorepo-diff-unmatched").
+		AndExitWith(0)
+
+	_, err := applyUnmatched(defaultAgent, UnmatchedConfig{Policy: unmatchedFail}, []string{"README.md"}, []Step{}, false)
+
+	assert.EqualError(t, err, "1 changed file(s) not covered by any watch entry")
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelineAddsUnmatchedFilesToDefaultStep(t *testing.T) {
+	plugin := Plugin{
+		Diff: "echo README.md",
+		Watch: []WatchConfig{
+			{
+				Paths: []string{"service-1/"},
+				Step:  Step{Trigger: "service-1"},
+			},
+			{
+				Default: true,
+				Step:    Step{Command: "echo default"},
+			},
+		},
+	}
+
+	var got []Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = steps
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	_, _, err := uploadPipeline(plugin, generator)
+	assert.NoError(t, err)
+
+	assert.Equal(t, []Step{
+		{
+			Command: "echo default",
+			Env:     map[string]string{unmatchedFilesEnv: "README.md"},
+		},
+	}, got)
+	assert.Nil(t, plugin.Watch[1].Step.Env)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUnmatchedEnv(t *testing.T) {
+	files := []string{"docs/$HOME.md", "README.md"}
+
+	assert.Equal(t, map[string]string{unmatchedFilesEnv: "docs/$$HOME.md README.md"}, unmatchedEnv(files, true))
+	assert.Equal(t, map[string]string{unmatchedFilesEnv: "docs/$HOME.md README.md"}, unmatchedEnv(files, false))
+}
+
+func TestApplyUnmatchedEscapesFiles(t *testing.T) {
+	config := UnmatchedConfig{Policy: unmatchedTrigger, Step: &Step{Command: "echo unmatched"}}
+
+	got, err := applyUnmatched(defaultAgent, config, []string{"docs/$HOME.md"}, []Step{}, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []Step{
+		{Command: "echo unmatched", Env: map[string]string{unmatchedFilesEnv: "docs/$$HOME.md"}},
+	}, got)
+}
+
 func TestGeneratePipeline(t *testing.T) {
 	steps := []Step{
 		{
@@ -472,6 +1184,75 @@ steps:
 	assert.Equal(t, want, string(got))
 }
 
+func TestGeneratePipelineFormats(t *testing.T) {
+	steps := []Step{
+		{
+			Trigger:  "foo-service-pipeline",
+			Build:    Build{Message: "build message", Env: map[string]string{"FOO": "123"}},
+			SoftFail: []interface{}{map[string]interface{}{"exit_status": float64(127)}},
+		},
+		{
+			Command: []string{"make test", "make lint"},
+			Agents:  Agent{"queue": "default"},
+			Notify: []StepNotify{
+				{GithubStatus: GithubStatusNotification{Context: "my-custom-status"}},
+			},
+		},
+		{
+			Group:   "my group",
+			Command: "echo group",
+		},
+	}
+
+	plugin := Plugin{
+		Wait: true,
+		Notify: []PluginNotify{
+			{Email: "foo@gmail.com", Condition: "build.state === \"failed\""},
+		},
+		Hooks: []HookConfig{
+			{Command: "echo \"hello world\""},
+		},
+	}
+
+	docs := map[string]interface{}{}
+
+	for _, format := range []string{yamlFormat, jsonFormat} {
+		plugin.Format = format
+
+		pipeline, _, err := generatePipeline(steps, plugin)
+		require.NoError(t, err)
+		defer os.Remove(pipeline.Name())
+
+		got, err := os.ReadFile(pipeline.Name())
+		require.NoError(t, err)
+
+		golden := filepath.Join("testdata", "pipeline."+format)
+		if *update {
+			require.NoError(t, os.WriteFile(golden, got, 0o644))
+		}
+
+		want, err := os.ReadFile(golden)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got), format)
+
+		var doc interface{}
+		if format == jsonFormat {
+			require.NoError(t, json.Unmarshal(got, &doc))
+		} else {
+			require.NoError(t, yaml.Unmarshal(got, &doc))
+
+			// round trip through JSON so that numbers are decoded the same way
+			b, err := json.Marshal(jsonValue(doc))
+			require.NoError(t, err)
+			require.NoError(t, json.Unmarshal(b, &doc))
+		}
+
+		docs[format] = doc
+	}
+
+	assert.Equal(t, docs[yamlFormat], docs[jsonFormat])
+}
+
 func TestGeneratePipelineWithNoStepsAndHooks(t *testing.T) {
 	steps := []Step{}
 
@@ -554,3 +1335,201 @@ func TestGeneratePipelinePreservesMetadata(t *testing.T) {
 
 	assert.Equal(t, want, string(got))
 }
+
+func TestUploadPipelinesUploadsEachInstance(t *testing.T) {
+	plugins := []Plugin{
+		{
+			Diff:  "echo service-a/main.go",
+			Watch: []WatchConfig{{Paths: []string{"service-a/"}, Step: Step{Trigger: "service-a"}}},
+		},
+		{
+			Diff:          "echo docs/index.md",
+			Interpolation: true,
+			Watch:         []WatchConfig{{Paths: []string{"docs/"}, Step: Step{Command: "make docs"}}},
+		},
+	}
+
+	var got [][]Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = append(got, steps)
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt").
+		AndExitWith(0)
+
+	err := uploadPipelines(plugins, generator)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]Step{
+		{{Trigger: "service-a"}},
+		{{Command: "make docs"}},
+	}, got)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelinesMergesInstances(t *testing.T) {
+	plugins := []Plugin{
+		{
+			Diff:  "echo service-a/main.go",
+			Merge: true,
+			Watch: []WatchConfig{
+				{Paths: []string{"service-a/"}, Step: Step{Trigger: "service-a"}},
+				{Paths: []string{"service-a/"}, Step: Step{Command: "make lint"}},
+			},
+		},
+		{
+			Diff:  "echo README.md",
+			Watch: []WatchConfig{{Paths: []string{"service-b/"}, Step: Step{Trigger: "service-b"}}},
+		},
+		{
+			Diff:  "echo docs/index.md",
+			Merge: true,
+			Watch: []WatchConfig{
+				{Paths: []string{"docs/"}, Step: Step{Command: "make docs"}},
+				{Paths: []string{"docs/"}, Step: Step{Command: "make lint"}},
+			},
+		},
+	}
+
+	var got [][]Step
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = append(got, steps)
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0).
+		Exactly(2)
+
+	err := uploadPipelines(plugins, generator)
+	assert.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, []Step{}, got[0])
+	assert.Equal(t, []Step{
+		{Trigger: "service-a"},
+		{Command: "make lint"},
+		{Command: "make docs"},
+	}, got[1])
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelinesMergesNotifyAndHooks(t *testing.T) {
+	plugins := []Plugin{
+		{
+			Diff:   "echo service-a/main.go",
+			Merge:  true,
+			Notify: []PluginNotify{{Email: "a@example.com"}, {Simple: "github_check"}},
+			Hooks:  []HookConfig{{Command: "echo a"}},
+			Watch:  []WatchConfig{{Paths: []string{"service-a/"}, Step: Step{Trigger: "service-a"}}},
+		},
+		{
+			Diff:   "echo docs/index.md",
+			Merge:  true,
+			Notify: []PluginNotify{{Email: "b@example.com"}, {Simple: "github_check"}},
+			Hooks:  []HookConfig{{Command: "echo b"}, {Command: "echo a"}},
+			Watch:  []WatchConfig{{Paths: []string{"docs/"}, Step: Step{Command: "make docs"}}},
+		},
+	}
+
+	var got Plugin
+	generator := func(steps []Step, plugin Plugin) (*os.File, bool, error) {
+		got = plugin
+		return mockGeneratePipeline(steps, plugin)
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt", "--no-interpolation").
+		AndExitWith(0)
+
+	err := uploadPipelines(plugins, generator)
+	require.NoError(t, err)
+
+	assert.Equal(t, []PluginNotify{
+		{Email: "a@example.com"},
+		{Simple: "github_check"},
+		{Email: "b@example.com"},
+	}, got.Notify)
+	assert.Equal(t, []HookConfig{{Command: "echo a"}, {Command: "echo b"}}, got.Hooks)
+
+	agent.CheckAndClose(t)
+}
+
+func TestUploadPipelinesReturnsInstanceError(t *testing.T) {
+	plugins := []Plugin{
+		{Diff: "echo README.md", Interpolation: true},
+		{Diff: "echo oops >&2; exit 1"},
+	}
+
+	agent := mockBuildkiteAgent(t)
+	agent.
+		Expect("pipeline", "upload", "pipeline.txt").
+		AndExitWith(0)
+	agent.
+		Expect("annotate", bintest.MatchAny(), "--style", "error", "--context", "monorepo-diff-diff-failure").
+		AndExitWith(0)
+
+	err := uploadPipelines(plugins, mockGeneratePipeline)
+
+	assert.EqualError(t, err, "instance 1: diff command failed: command `"+env("SHELL", "bash")+"` failed: exit status 1: oops")
+	assert.Equal(t, 3, exitCode(err))
+
+	agent.CheckAndClose(t)
+}
+
+func TestGeneratePipelineWithNotifySchema(t *testing.T) {
+	steps := []Step{
+		{
+			Command: "make test",
+			Notify: []StepNotify{
+				{Simple: "github_check"},
+				{Slack: SlackNotification{Channels: []string{"#service-a"}, Message: "Tests failed"}, Condition: "build.state == \"failed\""},
+				{GithubCheck: GithubStatusNotification{Context: "service-a"}},
+			},
+		},
+	}
+
+	plugin := Plugin{
+		Notify: []PluginNotify{
+			{Simple: "github_commit_status"},
+			{Slack: SlackNotification{Channels: []string{"#ci", "@someuser"}}},
+		},
+	}
+
+	pipeline, _, err := generatePipeline(steps, plugin)
+	require.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	want := `notify:
+- github_commit_status
+- slack:
+    channels:
+    - '#ci'
+    - '@someuser'
+steps:
+- command: make test
+  notify:
+  - github_check
+  - slack:
+      channels:
+      - '#service-a'
+      message: Tests failed
+    if: build.state == "failed"
+  - github_check:
+      context: service-a
+`
+
+	assert.Equal(t, want, string(got))
+}
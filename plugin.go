@@ -3,17 +3,52 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/url"
+	"os"
 	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
 const pluginName = "monorepo-diff"
 
+const defaultDiff = "git diff --name-only HEAD~1"
+
+// Policies for the keys set both by the plugin env and by a step
+const (
+	envMergePluginWins = "plugin_wins"
+	envMergeStepWins   = "step_wins"
+)
+
+// Steps the plugin env is added to
+const (
+	envTargetBoth    = "both"
+	envTargetCommand = "command"
+	envTargetTrigger = "trigger"
+)
+
+// instanceEnv selects a single instance of the plugin, by index or by id
+const instanceEnv = "MONOREPO_DIFF_INSTANCE"
+
+// Policies for changed files that no watch entry covers
+const (
+	unmatchedIgnore  = "ignore"
+	unmatchedWarn    = "warn"
+	unmatchedFail    = "fail"
+	unmatchedTrigger = "trigger"
+)
+
 // Plugin buildkite monorepo diff plugin structure
 type Plugin struct {
+	ID            string
 	Diff          string
 	Wait          bool
 	LogLevel      string `json:"log_level"`
@@ -22,8 +57,57 @@ type Plugin struct {
 	Watch         []WatchConfig
 	RawEnv        interface{} `json:"env"`
 	Env           map[string]string
-	RawNotify     []map[string]interface{} `json:"notify" yaml:",omitempty"`
-	Notify        []PluginNotify           `yaml:"notify,omitempty"`
+	EscapeEnv     bool           `json:"escape_env"`
+	EnvMerge      string         `json:"env_merge"`
+	EnvTarget     string         `json:"env_target"`
+	RawNotify     []interface{}  `json:"notify" yaml:",omitempty"`
+	Notify        []PluginNotify `yaml:"notify,omitempty"`
+	RawUnmatched  interface{}    `json:"unmatched" yaml:",omitempty"`
+	Unmatched     UnmatchedConfig
+	BaseCommit    string `json:"base_commit"`
+	WatchFile     string `json:"watch_file"`
+	ExposeChanges bool   `json:"expose_changes"`
+	SetMetaData   bool   `json:"set_meta_data"`
+	Output        string
+	RawUpload     *bool `json:"upload"`
+	SkipUpload    bool  `json:"-"`
+	Format        string
+	PrintPipeline string   `json:"print_pipeline"`
+	RedactEnv     []string `json:"redact_env"`
+	Deepen        *DeepenConfig
+	ForceAll      ForceAllConfig `json:"force_all"`
+	Signing       SigningConfig
+	Secrets       SecretsConfig
+	Replace       bool
+	RejectSecrets bool        `json:"reject_secrets"`
+	DryRun        bool        `json:"dry_run"`
+	AgentPath     string      `json:"agent_path"`
+	RawUploadEnv  interface{} `json:"upload_env" yaml:",omitempty"`
+	UploadEnv     map[string]string
+	RawDiscover   interface{} `json:"discover" yaml:",omitempty"`
+	Discover      []string
+	Templates     map[string]interface{} `yaml:",omitempty"`
+	Merge         bool
+
+	RawDiffTimeout        string `json:"diff_timeout"`
+	DiffTimeout           time.Duration
+	RawUploadTimeout      string `json:"upload_timeout"`
+	UploadTimeout         time.Duration
+	UploadRetries         int    `json:"upload_retries"`
+	RawUploadRetryBackoff string `json:"upload_retry_backoff"`
+	UploadRetryBackoff    time.Duration
+	OnDiffFailure         string `json:"on_diff_failure"`
+
+	// Instance names the instance in the meta-data keys when the plugin
+	// is used several times on the step: its id, or else its index
+	Instance string `json:"-"`
+}
+
+// UnmatchedConfig controls what happens to changed files that are not
+// covered by any watch entry
+type UnmatchedConfig struct {
+	Policy string
+	Step   *Step
 }
 
 // HookConfig Plugin hook configuration
@@ -33,12 +117,23 @@ type HookConfig struct {
 
 // WatchConfig Plugin watch configuration
 type WatchConfig struct {
+	ID          string      `json:"id"`
 	RawPath     interface{} `json:"path"`
 	Paths       []string
 	Step        Step        `json:"config"`
 	Default     interface{} `json:"default"`
 	RawSkipPath interface{} `json:"skip_path"`
 	SkipPaths   []string
+	RawBranches interface{} `json:"branches"`
+	Branches    []string
+	RawTags     interface{} `json:"tags"`
+	Tags        []string
+	When        string `json:"when"`
+	Dir         string `json:"-"`
+	DefaultMode string `json:"default_mode"`
+
+	// Condition is the parsed When expression
+	Condition expr `json:"-"`
 }
 
 type Group struct {
@@ -47,45 +142,63 @@ type Group struct {
 }
 
 // GithubStatusNotification is notification config for github_commit_status
+// and github_check
 type GithubStatusNotification struct {
 	Context string `yaml:"context,omitempty"`
 }
 
-// PluginNotify is notify configuration for pipeline
+// SlackNotification is the object form of the slack notification
+type SlackNotification struct {
+	Channels []string `yaml:"channels"`
+	Message  string   `yaml:"message,omitempty"`
+}
+
+// PluginNotify is notify configuration for pipeline. Slack is either a
+// string or a SlackNotification, and Simple holds the notifications
+// given as a plain string.
 type PluginNotify struct {
-	Slack        string                   `yaml:"slack,omitempty"`
+	Slack        interface{}              `yaml:"slack,omitempty"`
 	Email        string                   `yaml:"email,omitempty"`
 	PagerDuty    string                   `yaml:"pagerduty_change_event,omitempty"`
 	Webhook      string                   `yaml:"webhook,omitempty"`
 	Basecamp     string                   `yaml:"basecamp_campfire,omitempty"`
 	GithubStatus GithubStatusNotification `yaml:"github_commit_status,omitempty"`
+	GithubCheck  GithubStatusNotification `yaml:"github_check,omitempty"`
 	Condition    string                   `yaml:"if,omitempty"`
+	Simple       string                   `yaml:"-"`
 }
 
 // Notify is Buildkite notification definition
 type StepNotify struct {
-	Slack        string                   `yaml:"slack,omitempty"`
+	Slack        interface{}              `yaml:"slack,omitempty"`
 	Basecamp     string                   `yaml:"basecamp_campfire,omitempty"`
 	GithubStatus GithubStatusNotification `yaml:"github_commit_status,omitempty"`
+	GithubCheck  GithubStatusNotification `yaml:"github_check,omitempty"`
 	Condition    string                   `yaml:"if,omitempty"`
+	Simple       string                   `yaml:"-"`
 }
 
 // Step is buildkite pipeline definition
 type Step struct {
-	Group     string                   `yaml:"group,omitempty"`
-	Trigger   string                   `yaml:"trigger,omitempty"`
-	Label     string                   `yaml:"label,omitempty"`
-	Build     Build                    `yaml:"build,omitempty"`
-	Command   interface{}              `yaml:"command,omitempty"`
-	Commands  interface{}              `yaml:"commands,omitempty"`
-	Agents    Agent                    `yaml:"agents,omitempty"`
-	Artifacts []string                 `yaml:"artifacts,omitempty"`
-	RawEnv    interface{}              `json:"env" yaml:",omitempty"`
-	Env       map[string]string        `yaml:"env,omitempty"`
-	Async     bool                     `yaml:"async,omitempty"`
-	SoftFail  interface{}              `json:"soft_fail" yaml:"soft_fail,omitempty"`
-	RawNotify []map[string]interface{} `json:"notify" yaml:",omitempty"`
-	Notify    []StepNotify             `yaml:"notify,omitempty"`
+	Group     string            `yaml:"group,omitempty"`
+	Trigger   string            `yaml:"trigger,omitempty"`
+	Label     string            `yaml:"label,omitempty"`
+	Build     Build             `yaml:"build,omitempty"`
+	Command   interface{}       `yaml:"command,omitempty"`
+	Commands  interface{}       `yaml:"commands,omitempty"`
+	Plugins   interface{}       `yaml:"plugins,omitempty"`
+	Retry     interface{}       `yaml:"retry,omitempty"`
+	Agents    Agent             `yaml:"agents,omitempty"`
+	Artifacts []string          `yaml:"artifacts,omitempty"`
+	RawEnv    interface{}       `json:"env" yaml:",omitempty"`
+	Env       map[string]string `yaml:"env,omitempty"`
+	Async     bool              `yaml:"async,omitempty"`
+	SoftFail  interface{}       `json:"soft_fail" yaml:"soft_fail,omitempty"`
+	RawNotify []interface{}     `json:"notify" yaml:",omitempty"`
+	Notify    []StepNotify      `yaml:"notify,omitempty"`
+
+	InheritEnv *bool             `json:"inherit_env" yaml:"-"`
+	Secrets    map[string]string `json:"-" yaml:"secrets,omitempty"`
 }
 
 // Agent is Buildkite agent definition
@@ -127,79 +240,296 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 	type plain Plugin
 
 	def := &plain{
-		Diff:          "git diff --name-only HEAD~1",
+		Diff:          defaultDiff,
 		Wait:          false,
 		LogLevel:      "info",
 		Interpolation: true,
 	}
 
+	data, err := resolveTemplates(data)
+	if err != nil {
+		return err
+	}
+
 	if err := json.Unmarshal(data, def); err != nil {
 		return err
 	}
 
 	*plugin = Plugin(*def)
 
+	if plugin.BaseCommit != "" && plugin.Diff == defaultDiff {
+		plugin.Diff = "git diff --name-only " + shellQuote(plugin.BaseCommit)
+	}
+
+	if plugin.Format != "" && plugin.Format != yamlFormat && plugin.Format != jsonFormat {
+		return fmt.Errorf("format: expected %s or %s, got %s", yamlFormat, jsonFormat, plugin.Format)
+	}
+
+	switch plugin.PrintPipeline {
+	case "", printFull, printSummary, printNone:
+	default:
+		return fmt.Errorf(
+			"print_pipeline: expected %s, %s or %s, got %s", printFull, printSummary, printNone, plugin.PrintPipeline,
+		)
+	}
+
+	if err := validateRedactEnv(plugin.RedactEnv); err != nil {
+		return err
+	}
+
+	switch plugin.OnDiffFailure {
+	case "", diffFailureFail, diffFailureTriggerAll, diffFailureTriggerDefault, diffFailureSkip:
+	default:
+		return fmt.Errorf(
+			"on_diff_failure: expected one of %s, %s, %s or %s, got %s",
+			diffFailureFail, diffFailureTriggerAll, diffFailureTriggerDefault, diffFailureSkip, plugin.OnDiffFailure,
+		)
+	}
+
+	if err := plugin.Signing.validate(); err != nil {
+		return err
+	}
+
+	if err := plugin.Secrets.validate(); err != nil {
+		return err
+	}
+
+	if plugin.Deepen != nil {
+		if err := plugin.Deepen.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if err := validatePatterns(plugin.ForceAll.Branches); err != nil {
+		return fmt.Errorf("force_all: branches: %v", err)
+	}
+
+	if plugin.Output == artifactOutputPrefix {
+		return errors.New("output: artifact path is missing")
+	}
+
+	switch plugin.EnvMerge {
+	case "", envMergePluginWins, envMergeStepWins:
+	default:
+		return fmt.Errorf("env_merge: expected %s or %s, got %s", envMergePluginWins, envMergeStepWins, plugin.EnvMerge)
+	}
+
+	switch plugin.EnvTarget {
+	case "", envTargetBoth, envTargetCommand, envTargetTrigger:
+	default:
+		return fmt.Errorf(
+			"env_target: expected %s, %s or %s, got %s", envTargetBoth, envTargetCommand, envTargetTrigger, plugin.EnvTarget,
+		)
+	}
+
 	parseResult, err := parseEnv(plugin.RawEnv)
 	if err != nil {
-		return errors.New("failed to parse plugin configuration")
+		return fmt.Errorf("env: %v", err)
 	}
 
 	plugin.Env = parseResult
 	plugin.RawEnv = nil
 
-	setPluginNotify(&plugin.Notify, &plugin.RawNotify)
+	uploadEnv, err := parseEnv(plugin.RawUploadEnv)
+	if err != nil {
+		return fmt.Errorf("upload_env: %v", err)
+	}
+
+	plugin.UploadEnv = uploadEnv
+	plugin.RawUploadEnv = nil
+
+	plugin.SkipUpload = plugin.RawUpload != nil && !*plugin.RawUpload
+	plugin.RawUpload = nil
+
+	if err := plugin.validateUpload(); err != nil {
+		return err
+	}
+
+	if err := plugin.parseTimeouts(); err != nil {
+		return err
+	}
+
+	if err := setPluginNotify(&plugin.Notify, &plugin.RawNotify); err != nil {
+		return err
+	}
+
+	unmatched, err := parseUnmatched(plugin.RawUnmatched, plugin)
+	if err != nil {
+		return err
+	}
+
+	plugin.Unmatched = unmatched
+	plugin.RawUnmatched = nil
+
+	labels := make([]string, len(plugin.Watch))
+	for i := range plugin.Watch {
+		labels[i] = fmt.Sprintf("watch[%d]", i)
+	}
+
+	if plugin.WatchFile != "" {
+		watch, fileLabels, err := loadWatchFile(plugin.WatchFile, plugin.Templates)
+		if err != nil {
+			return err
+		}
+
+		plugin.Watch = append(plugin.Watch, watch...)
+		labels = append(labels, fileLabels...)
+	}
+
+	discover, err := stringList(plugin.RawDiscover)
+	if err != nil {
+		return fmt.Errorf("discover: %v", err)
+	}
+
+	plugin.Discover = discover
+	plugin.RawDiscover = nil
+
+	if len(plugin.Discover) > 0 {
+		watch, discoveredLabels, err := discoverWatch(plugin.Discover, plugin.Templates)
+		if err != nil {
+			return err
+		}
+
+		plugin.Watch = append(plugin.Watch, watch...)
+		labels = append(labels, discoveredLabels...)
+	}
+
+	if err := checkIDs(plugin.Watch, labels); err != nil {
+		return err
+	}
+
+	if err := checkDefaults(plugin.Watch, labels); err != nil {
+		return err
+	}
+
+	watch, labels, err := expandDefaults(plugin.Watch, labels)
+	if err != nil {
+		return err
+	}
+
+	plugin.Watch = watch
+
+	if err := parseWatch(plugin.Watch, labels, plugin); err != nil {
+		return err
+	}
+
+	if plugin.EscapeEnv && plugin.Interpolation {
+		for i := range plugin.Watch {
+			escapeEnv(&plugin.Watch[i].Step)
+		}
+
+		if plugin.Unmatched.Step != nil {
+			escapeEnv(plugin.Unmatched.Step)
+		}
+	}
+
+	return plugin.setupSecrets(labels)
+}
+
+// parseWatch converts the raw fields of the watch entries and applies the
+// plugin env to their steps. labels name each entry in errors.
+func parseWatch(watch []WatchConfig, labels []string, plugin *Plugin) error {
+	for i, p := range watch {
+		switch p.DefaultMode {
+		case "", defaultModeFallback, defaultModeAlways:
+		default:
+			return fmt.Errorf(
+				"%s: default_mode: expected %s or %s, got %s",
+				labels[i], defaultModeFallback, defaultModeAlways, p.DefaultMode,
+			)
+		}
+
+		if p.DefaultMode != "" && p.Default == nil {
+			return fmt.Errorf("%s: default_mode is only valid with default", labels[i])
+		}
 
-	for i, p := range plugin.Watch {
 		if p.Default != nil {
-			plugin.Watch[i].Paths = []string{}
+			watch[i].Paths = []string{}
 			if config, ok := p.Default.(map[string]interface{}); ok && len(config) > 0 {
 				conf := config
-				if _, ok := config["config"]; ok {
-					conf = config["config"].(map[string]interface{})
+				if c, ok := config["config"]; ok {
+					if conf, ok = c.(map[string]interface{}); !ok {
+						return fmt.Errorf("%s: default: config must be a step", labels[i])
+					}
 				}
 
 				// Convert config to JSON
 				b, _ := json.Marshal(conf)
 
 				// Unmarshal into Step, which will use our custom Build UnmarshalJSON
-				if err := json.Unmarshal(b, &plugin.Watch[i].Step); err != nil {
-					return err
+				if err := json.Unmarshal(b, &watch[i].Step); err != nil {
+					return fmt.Errorf("%s: default: %v", labels[i], err)
 				}
 			}
-			plugin.Watch[i].Default = true
+			watch[i].Default = true
 		} else if p.RawPath != nil {
-			// Handle path configuration
-			switch p.RawPath.(type) {
-			case string:
-				plugin.Watch[i].Paths = []string{plugin.Watch[i].RawPath.(string)}
-			case []interface{}:
-				for _, v := range plugin.Watch[i].RawPath.([]interface{}) {
-					plugin.Watch[i].Paths = append(plugin.Watch[i].Paths, v.(string))
+			paths, err := stringList(p.RawPath)
+			if err != nil {
+				return fmt.Errorf("%s: path: %v", labels[i], err)
+			}
+
+			watch[i].Paths = paths
+		}
+
+		skipPaths, err := stringList(p.RawSkipPath)
+		if err != nil {
+			return fmt.Errorf("%s: skip_path: %v", labels[i], err)
+		}
+
+		watch[i].SkipPaths = skipPaths
+
+		if p.Dir != "" {
+			for _, paths := range [][]string{watch[i].Paths, watch[i].SkipPaths} {
+				for j, pattern := range paths {
+					if paths[j], err = inDir(p.Dir, pattern); err != nil {
+						return fmt.Errorf("%s: %v", labels[i], err)
+					}
 				}
 			}
 		}
 
-		// Handle skip paths
-		switch p.RawSkipPath.(type) {
-		case string:
-			plugin.Watch[i].SkipPaths = []string{plugin.Watch[i].RawSkipPath.(string)}
-		case []interface{}:
-			for _, v := range plugin.Watch[i].RawSkipPath.([]interface{}) {
-				plugin.Watch[i].SkipPaths = append(plugin.Watch[i].SkipPaths, v.(string))
+		branches, err := stringList(p.RawBranches)
+		if err != nil {
+			return fmt.Errorf("%s: branches: %v", labels[i], err)
+		}
+
+		tags, err := stringList(p.RawTags)
+		if err != nil {
+			return fmt.Errorf("%s: tags: %v", labels[i], err)
+		}
+
+		if err := validatePatterns(append(branches, tags...)); err != nil {
+			return fmt.Errorf("%s: %v", labels[i], err)
+		}
+
+		if p.When != "" {
+			condition, err := parseExpression(p.When)
+			if err != nil {
+				return fmt.Errorf("%s: when: %v", labels[i], err)
 			}
+			watch[i].Condition = condition
 		}
 
+		watch[i].Branches = branches
+		watch[i].Tags = tags
+		watch[i].RawBranches = nil
+		watch[i].RawTags = nil
+
 		// Only set defaults if there's a trigger
-		if plugin.Watch[i].Step.Trigger != "" {
+		if watch[i].Step.Trigger != "" {
 			// Use our updated setBuild that preserves metadata
-			setBuild(&plugin.Watch[i].Step.Build)
+			setBuild(&watch[i].Step.Build)
 		}
 
-		if plugin.Watch[i].Step.RawNotify != nil {
-			setNotify(&plugin.Watch[i].Step.Notify, &plugin.Watch[i].Step.RawNotify)
+		if watch[i].Step.RawNotify != nil {
+			if err := setNotify(&watch[i].Step.Notify, &watch[i].Step.RawNotify); err != nil {
+				return fmt.Errorf("%s: %v", labels[i], err)
+			}
 		}
 
-		appendEnv(&plugin.Watch[i], plugin.Env)
+		if err := appendEnv(&watch[i], plugin); err != nil {
+			return fmt.Errorf("%s: %v", labels[i], err)
+		}
 
 		p.RawPath = nil
 		p.RawSkipPath = nil
@@ -208,114 +538,531 @@ func (plugin *Plugin) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// expandDefaults turns the watch entries with a list of default steps
+// into one entry per step, along with the labels of the resulting entries.
+func expandDefaults(watch []WatchConfig, labels []string) ([]WatchConfig, []string, error) {
+	var result []WatchConfig
+	var resultLabels []string
+
+	for i, w := range watch {
+		list, ok := w.Default.([]interface{})
+		if !ok {
+			result = append(result, w)
+			resultLabels = append(resultLabels, labels[i])
+			continue
+		}
+
+		for _, step := range list {
+			if _, ok := step.(map[string]interface{}); !ok {
+				return nil, nil, fmt.Errorf("%s: default: expected a list of steps", labels[i])
+			}
+
+			entry := w
+			entry.Default = step
+			result = append(result, entry)
+			resultLabels = append(resultLabels, labels[i])
+		}
+	}
+
+	return result, resultLabels, nil
+}
+
+// validateUpload rejects combinations of upload options that conflict.
+func (plugin Plugin) validateUpload() error {
+	if plugin.SkipUpload {
+		options := []struct {
+			name string
+			set  bool
+		}{
+			{"replace", plugin.Replace},
+			{"reject_secrets", plugin.RejectSecrets},
+			{"dry_run", plugin.DryRun},
+			{"signing", plugin.Signing.JWKSFile != ""},
+		}
+
+		for _, option := range options {
+			if option.set {
+				return fmt.Errorf("%s has no effect when upload is false", option.name)
+			}
+		}
+	}
+
+	if plugin.DryRun && plugin.Replace {
+		return errors.New("replace cannot be used with dry_run")
+	}
+
+	return nil
+}
+
+// parseTimeouts reads the durations of the timeout and retry options.
+func (plugin *Plugin) parseTimeouts() error {
+	durations := []struct {
+		option string
+		raw    *string
+		value  *time.Duration
+	}{
+		{"diff_timeout", &plugin.RawDiffTimeout, &plugin.DiffTimeout},
+		{"upload_timeout", &plugin.RawUploadTimeout, &plugin.UploadTimeout},
+		{"upload_retry_backoff", &plugin.RawUploadRetryBackoff, &plugin.UploadRetryBackoff},
+	}
+
+	for _, d := range durations {
+		if *d.raw == "" {
+			continue
+		}
+
+		value, err := time.ParseDuration(*d.raw)
+		if err != nil || value < 0 {
+			return fmt.Errorf("%s: invalid duration %q", d.option, *d.raw)
+		}
+
+		*d.value = value
+		*d.raw = ""
+	}
+
+	if plugin.UploadRetries < 0 {
+		return errors.New("upload_retries cannot be negative")
+	}
+
+	return nil
+}
+
+// agent returns the buildkite-agent binary to run.
+func (plugin Plugin) agent() string {
+	if plugin.AgentPath != "" {
+		return plugin.AgentPath
+	}
+
+	return defaultAgent
+}
+
+// initializePlugin returns the first instance of the plugin.
 func initializePlugin(data string) (Plugin, error) {
+	plugins, err := initializePlugins(data)
+	if err != nil {
+		return Plugin{}, err
+	}
+
+	return plugins[0], nil
+}
+
+// initializePlugins returns every instance of the plugin, in order.
+func initializePlugins(data string) ([]Plugin, error) {
 	log.Debugf("parsing plugin config: %v", data)
 
 	var pluginConfigs []map[string]json.RawMessage
 
 	if err := json.Unmarshal([]byte(data), &pluginConfigs); err != nil {
 		log.Debug(err)
-		return Plugin{}, errors.New("failed to parse plugin configuration")
+		return nil, newError(configError, errors.New("failed to parse plugin configuration"))
 	}
 
+	plugins := []Plugin{}
+
 	for _, p := range pluginConfigs {
 		for key, pluginConfig := range p {
-			if strings.HasPrefix(getPluginName(key), pluginName) {
+			if isPluginReference(key) {
 				var plugin Plugin
 
 				if err := json.Unmarshal(pluginConfig, &plugin); err != nil {
 					log.Debug(err)
-					return Plugin{}, errors.New("failed to parse plugin configuration")
+					if len(plugins) > 0 {
+						err = fmt.Errorf("instance %d: %v", len(plugins), err)
+					}
+					return nil, newError(configError, fmt.Errorf("failed to parse plugin configuration: %v", err))
 				}
 
-				return plugin, nil
+				plugins = append(plugins, plugin)
 			}
 		}
 	}
 
-	return Plugin{}, errors.New("could not initialize plugin")
-}
+	if len(plugins) == 0 {
+		return nil, newError(configError, errors.New("could not initialize plugin"))
+	}
+
+	if err := checkInstanceIDs(plugins); err != nil {
+		return nil, newError(configError, err)
+	}
 
-func setPluginNotify(notifications *[]PluginNotify, rawNotify *[]map[string]interface{}) {
-	for _, v := range *rawNotify {
-		var notify PluginNotify
+	if err := checkMergedInstances(plugins); err != nil {
+		return nil, newError(configError, err)
+	}
 
-		if condition, ok := isString(v["if"]); ok {
-			notify.Condition = condition
+	if len(plugins) > 1 {
+		for i := range plugins {
+			plugins[i].Instance = plugins[i].ID
+			if plugins[i].Instance == "" {
+				plugins[i].Instance = strconv.Itoa(i)
+			}
 		}
+	}
 
-		if email, ok := isString(v["email"]); ok {
-			notify.Email = email
-			*notifications = append(*notifications, notify)
-			continue
+	if instance, ok := os.LookupEnv(instanceEnv); ok {
+		plugin, err := selectInstance(plugins, instance)
+		if err != nil {
+			return nil, newError(configError, err)
 		}
 
-		if basecamp, ok := isString(v["basecamp_campfire"]); ok {
-			notify.Basecamp = basecamp
-			*notifications = append(*notifications, notify)
+		log.Debugf("%s selects instance %s", instanceEnv, instance)
+		return []Plugin{plugin}, nil
+	}
+
+	return plugins, nil
+}
+
+// checkInstanceIDs rejects plugin instances sharing an id.
+func checkInstanceIDs(plugins []Plugin) error {
+	seen := map[string]int{}
+
+	for i, plugin := range plugins {
+		if plugin.ID == "" {
 			continue
 		}
 
-		if webhook, ok := isString(v["webhook"]); ok {
-			notify.Webhook = webhook
-			*notifications = append(*notifications, notify)
-			continue
+		if first, ok := seen[plugin.ID]; ok {
+			return fmt.Errorf("instance %d: id %s is already used by instance %d", i, plugin.ID, first)
 		}
+		seen[plugin.ID] = i
+	}
+
+	return nil
+}
+
+// checkMergedInstances rejects merged instances whose upload options
+// differ from those of the first merged instance, as their steps are
+// uploaded in a single pipeline.
+func checkMergedInstances(plugins []Plugin) error {
+	first := -1
 
-		if pagerduty, ok := isString(v["pagerduty_change_event"]); ok {
-			notify.PagerDuty = pagerduty
-			*notifications = append(*notifications, notify)
+	for i, plugin := range plugins {
+		if !plugin.Merge {
 			continue
 		}
 
-		if slack, ok := isString(v["slack"]); ok {
-			notify.Slack = slack
-			*notifications = append(*notifications, notify)
+		if first < 0 {
+			first = i
 			continue
 		}
 
-		if github, ok := v["github_commit_status"].(map[string]interface{}); ok {
-			if context, ok := isString(github["context"]); ok {
-				notify.GithubStatus = GithubStatusNotification{Context: context}
-				*notifications = append(*notifications, notify)
+		other := plugins[first]
+		options := []struct {
+			name  string
+			value interface{}
+			other interface{}
+		}{
+			{"wait", plugin.Wait, other.Wait},
+			{"interpolation", plugin.Interpolation, other.Interpolation},
+			{"format", plugin.Format, other.Format},
+			{"output", plugin.Output, other.Output},
+			{"upload", plugin.SkipUpload, other.SkipUpload},
+			{"replace", plugin.Replace, other.Replace},
+			{"reject_secrets", plugin.RejectSecrets, other.RejectSecrets},
+			{"dry_run", plugin.DryRun, other.DryRun},
+			{"agent_path", plugin.AgentPath, other.AgentPath},
+			{"upload_env", plugin.UploadEnv, other.UploadEnv},
+			{"signing", plugin.Signing, other.Signing},
+			{"print_pipeline", plugin.PrintPipeline, other.PrintPipeline},
+			{"redact_env", plugin.RedactEnv, other.RedactEnv},
+			{"upload_timeout", plugin.UploadTimeout, other.UploadTimeout},
+			{"upload_retries", plugin.UploadRetries, other.UploadRetries},
+			{"upload_retry_backoff", plugin.UploadRetryBackoff, other.UploadRetryBackoff},
+		}
+
+		for _, option := range options {
+			if !reflect.DeepEqual(option.value, option.other) {
+				return fmt.Errorf(
+					"instance %d: %s must be the same as in instance %d to merge their steps", i, option.name, first,
+				)
 			}
-			continue
 		}
 	}
 
-	*rawNotify = nil
+	return nil
 }
 
-func setNotify(notifications *[]StepNotify, rawNotify *[]map[string]interface{}) {
-	for _, v := range *rawNotify {
-		var notify StepNotify
+// selectInstance returns the plugin instance with the id, or else at
+// the index, instance.
+func selectInstance(plugins []Plugin, instance string) (Plugin, error) {
+	for _, plugin := range plugins {
+		if plugin.ID != "" && plugin.ID == instance {
+			return plugin, nil
+		}
+	}
+
+	if i, err := strconv.Atoi(instance); err == nil && i >= 0 && i < len(plugins) {
+		return plugins[i], nil
+	}
 
-		if condition, ok := isString(v["if"]); ok {
-			notify.Condition = condition
+	return Plugin{}, fmt.Errorf("%s: no instance with id or index %q", instanceEnv, instance)
+}
+
+// parseUnmatched reads the `unmatched` option, which is either a policy name
+// or an object with a `trigger` key holding a pipeline slug or step config.
+func parseUnmatched(raw interface{}, plugin *Plugin) (UnmatchedConfig, error) {
+	switch raw := raw.(type) {
+	case nil:
+		return UnmatchedConfig{}, nil
+	case string:
+		switch raw {
+		case unmatchedIgnore, unmatchedWarn, unmatchedFail:
+			return UnmatchedConfig{Policy: raw}, nil
 		}
+	case map[string]interface{}:
+		var step Step
 
-		if basecamp, ok := isString(v["basecamp_campfire"]); ok {
-			notify.Basecamp = basecamp
-			*notifications = append(*notifications, notify)
-			continue
+		switch trigger := raw["trigger"].(type) {
+		case string:
+			step.Trigger = trigger
+		case map[string]interface{}:
+			b, _ := json.Marshal(trigger)
+			if err := json.Unmarshal(b, &step); err != nil {
+				return UnmatchedConfig{}, err
+			}
+		default:
+			return UnmatchedConfig{}, errors.New("unmatched: trigger must be a pipeline slug or a step config")
 		}
 
-		if slack, ok := isString(v["slack"]); ok {
-			notify.Slack = slack
-			*notifications = append(*notifications, notify)
-			continue
+		watch := WatchConfig{Step: step}
+		if watch.Step.Trigger != "" {
+			setBuild(&watch.Step.Build)
 		}
 
-		if github, ok := v["github_commit_status"].(map[string]interface{}); ok {
-			if context, ok := isString(github["context"]); ok {
-				notify.GithubStatus = GithubStatusNotification{Context: context}
-				*notifications = append(*notifications, notify)
+		if watch.Step.RawNotify != nil {
+			if err := setNotify(&watch.Step.Notify, &watch.Step.RawNotify); err != nil {
+				return UnmatchedConfig{}, fmt.Errorf("unmatched: trigger: %v", err)
 			}
+		}
+
+		if err := appendEnv(&watch, plugin); err != nil {
+			return UnmatchedConfig{}, fmt.Errorf("unmatched: trigger: %v", err)
+		}
+
+		return UnmatchedConfig{Policy: unmatchedTrigger, Step: &watch.Step}, nil
+	}
+
+	return UnmatchedConfig{}, fmt.Errorf(
+		"unmatched: expected one of %s, %s, %s or a trigger", unmatchedIgnore, unmatchedWarn, unmatchedFail,
+	)
+}
+
+func setPluginNotify(notifications *[]PluginNotify, rawNotify *[]interface{}) error {
+	for i, v := range *rawNotify {
+		notify, err := parseNotification(v)
+		if err != nil {
+			return fmt.Errorf("notify[%d]: %v", i, err)
+		}
+
+		*notifications = append(*notifications, notify)
+	}
+
+	*rawNotify = nil
+
+	return nil
+}
+
+func setNotify(notifications *[]StepNotify, rawNotify *[]interface{}) error {
+	for i, v := range *rawNotify {
+		notify, err := parseNotification(v)
+		if err != nil {
+			return fmt.Errorf("notify[%d]: %v", i, err)
+		}
+
+		// for compatibility with existing configurations, notifications
+		// steps don't support are dropped instead of being errors
+		if kind := buildNotification(notify); kind != "" {
+			log.Warnf(
+				"notify[%d]: %s notifications are not supported on steps and are dropped, set them in the notify of the plugin",
+				i, kind,
+			)
 			continue
 		}
+
+		*notifications = append(*notifications, StepNotify{
+			Slack:        notify.Slack,
+			Basecamp:     notify.Basecamp,
+			GithubStatus: notify.GithubStatus,
+			GithubCheck:  notify.GithubCheck,
+			Condition:    notify.Condition,
+			Simple:       notify.Simple,
+		})
 	}
 
 	*rawNotify = nil
+
+	return nil
+}
+
+// buildNotification returns the type of notify if only builds support it,
+// not steps.
+func buildNotification(notify PluginNotify) string {
+	switch {
+	case notify.Email != "":
+		return "email"
+	case notify.Webhook != "":
+		return "webhook"
+	case notify.PagerDuty != "":
+		return "pagerduty_change_event"
+	}
+
+	return ""
+}
+
+// simpleNotifications are the notifications that may be given as a plain
+// string, without any configuration
+var simpleNotifications = map[string]bool{
+	"github_check":         true,
+	"github_commit_status": true,
+}
+
+// parseNotification reads a notification of the Buildkite notify schema,
+// https://buildkite.com/docs/pipelines/configure/notifications, for a
+// build or for a step.
+func parseNotification(raw interface{}) (PluginNotify, error) {
+	var notify PluginNotify
+
+	if name, ok := raw.(string); ok {
+		if !simpleNotifications[name] {
+			return notify, fmt.Errorf("unknown notification %s", name)
+		}
+
+		notify.Simple = name
+		return notify, nil
+	}
+
+	config, ok := raw.(map[string]interface{})
+	if !ok {
+		return notify, fmt.Errorf("expected a notification, got %v", raw)
+	}
+
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		if key != "if" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	switch len(keys) {
+	case 0:
+		return notify, errors.New("missing notification type")
+	case 1:
+	default:
+		return notify, fmt.Errorf("expected a single notification, got %s", strings.Join(keys, ", "))
+	}
+
+	if condition, ok := config["if"]; ok {
+		if notify.Condition, ok = condition.(string); !ok {
+			return notify, fmt.Errorf("if: expected a string, got %v", condition)
+		}
+	}
+
+	kind, value := keys[0], config[keys[0]]
+
+	var err error
+
+	switch kind {
+	case "email":
+		notify.Email, err = notificationString(value)
+	case "basecamp_campfire":
+		notify.Basecamp, err = notificationString(value)
+	case "webhook":
+		notify.Webhook, err = notificationString(value)
+	case "pagerduty_change_event":
+		notify.PagerDuty, err = notificationString(value)
+	case "slack":
+		notify.Slack, err = parseSlackNotification(value)
+	case "github_commit_status":
+		notify.GithubStatus, err = parseGithubNotification(value)
+	case "github_check":
+		notify.GithubCheck, err = parseGithubNotification(value)
+	default:
+		return notify, fmt.Errorf("unknown notification type %s", kind)
+	}
+
+	if err != nil {
+		return notify, fmt.Errorf("%s: %v", kind, err)
+	}
+
+	return notify, nil
+}
+
+func notificationString(raw interface{}) (string, error) {
+	s, ok := raw.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("expected a string, got %v", raw)
+	}
+
+	return s, nil
+}
+
+// parseSlackNotification reads a slack notification, either a channel or
+// user, or an object with channels and a message.
+func parseSlackNotification(raw interface{}) (interface{}, error) {
+	if channel, ok := raw.(string); ok && channel != "" {
+		return channel, nil
+	}
+
+	config, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a channel or an object with channels, got %v", raw)
+	}
+
+	var slack SlackNotification
+
+	for key, value := range config {
+		switch key {
+		case "channels":
+			channels, err := stringList(value)
+			if err != nil {
+				return nil, fmt.Errorf("channels: %v", err)
+			}
+			slack.Channels = channels
+		case "message":
+			message, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("message: expected a string, got %v", value)
+			}
+			slack.Message = message
+		default:
+			return nil, fmt.Errorf("unknown key %s", key)
+		}
+	}
+
+	if len(slack.Channels) == 0 {
+		return nil, errors.New("channels is required")
+	}
+
+	return slack, nil
+}
+
+// parseGithubNotification reads the config of a github_commit_status or
+// github_check notification.
+func parseGithubNotification(raw interface{}) (GithubStatusNotification, error) {
+	config, ok := raw.(map[string]interface{})
+	if !ok {
+		return GithubStatusNotification{}, fmt.Errorf("expected an object with a context, got %v", raw)
+	}
+
+	var github GithubStatusNotification
+
+	for key, value := range config {
+		if key != "context" {
+			return github, fmt.Errorf("unknown key %s", key)
+		}
+
+		context, ok := value.(string)
+		if !ok || context == "" {
+			return github, fmt.Errorf("context: expected a string, got %v", value)
+		}
+		github.Context = context
+	}
+
+	if github.Context == "" {
+		return github, errors.New("context is required")
+	}
+
+	return github, nil
 }
 
 func escapeInterpolation(s string) string {
@@ -342,77 +1089,193 @@ func setBuild(build *Build) {
 	}
 }
 
-// appends top level env to Step.Env and Step.Build.Env
-func appendEnv(watch *WatchConfig, env map[string]string) {
-	watch.Step.Env, _ = parseEnv(watch.Step.RawEnv)
-	watch.Step.Build.Env, _ = parseEnv(watch.Step.Build.RawEnv)
-
-	for key, value := range env {
-		if watch.Step.Command != nil || watch.Step.Commands != nil {
-			if watch.Step.Env == nil {
-				watch.Step.Env = make(map[string]string)
-			}
+// appendEnv adds the plugin env to the env of command steps, or the
+// build env of triggers, as selected by env_target. The plugin env
+// overrides the keys the step sets itself, unless env_merge is
+// step_wins, and is not added to steps with inherit_env false.
+func appendEnv(watch *WatchConfig, plugin *Plugin) error {
+	var err error
 
-			watch.Step.Env[key] = value
-			continue
-		}
-		if watch.Step.Trigger != "" {
-			if watch.Step.Build.Env == nil {
-				watch.Step.Build.Env = make(map[string]string)
-			}
+	if watch.Step.Env, err = parseEnv(watch.Step.RawEnv); err != nil {
+		return fmt.Errorf("env: %v", err)
+	}
 
-			watch.Step.Build.Env[key] = value
-			continue
-		}
+	if watch.Step.Build.Env, err = parseEnv(watch.Step.Build.RawEnv); err != nil {
+		return fmt.Errorf("build: env: %v", err)
 	}
 
 	watch.Step.RawEnv = nil
 	watch.Step.Build.RawEnv = nil
 	watch.RawPath = nil
 	watch.RawSkipPath = nil
+
+	if watch.Step.InheritEnv != nil && !*watch.Step.InheritEnv {
+		return nil
+	}
+
+	isCommand := watch.Step.Command != nil || watch.Step.Commands != nil
+
+	switch {
+	case isCommand && plugin.EnvTarget != envTargetTrigger:
+		watch.Step.Env = inheritEnv(watch.Step.Env, plugin.Env, plugin.EnvMerge)
+	case !isCommand && watch.Step.Trigger != "" && plugin.EnvTarget != envTargetCommand:
+		watch.Step.Build.Env = inheritEnv(watch.Step.Build.Env, plugin.Env, plugin.EnvMerge)
+	}
+
+	return nil
 }
 
-// parse env in format from env=env-value to map[env] = env-value
-func parseEnv(raw interface{}) (map[string]string, error) {
-	if raw == nil {
-		return nil, nil
+// inheritEnv adds the plugin env to the env of a step, following the
+// env_merge policy.
+func inheritEnv(stepEnv map[string]string, pluginEnv map[string]string, policy string) map[string]string {
+	for key, value := range pluginEnv {
+		if stepEnv == nil {
+			stepEnv = make(map[string]string)
+		}
+
+		if _, ok := stepEnv[key]; ok && policy == envMergeStepWins {
+			continue
+		}
+
+		stepEnv[key] = value
 	}
 
-	if _, ok := raw.([]interface{}); !ok {
-		return nil, errors.New("failed to parse plugin configuration")
+	return stepEnv
+}
+
+// stringList converts a string or a list of strings to a list.
+func stringList(raw interface{}) ([]string, error) {
+	switch raw := raw.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{raw}, nil
+	case []interface{}:
+		if len(raw) == 0 {
+			return nil, nil
+		}
+
+		result := make([]string, len(raw))
+		for i, v := range raw {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected a string, got %v", v)
+			}
+			result[i] = s
+		}
+		return result, nil
 	}
 
-	result := make(map[string]string)
-	for _, v := range raw.([]interface{}) {
-		split := strings.Split(v.(string), "=")
-		key, value := strings.TrimSpace(split[0]), split[1:]
+	return nil, fmt.Errorf("expected a string or a list of strings, got %v", raw)
+}
 
-		// only key exists. set value from env
-		if len(key) > 0 && len(value) == 0 {
-			result[key] = env(key, "")
+// maxExactInteger is the largest integer a float64 holds exactly
+const maxExactInteger = 1 << 53
+
+// parseEnv reads env, either a list of KEY=VALUE strings or a map of
+// keys to values. The value of a key without one, either KEY in a list
+// or a null value in a map, is read from the environment. Values of
+// the form {secret: NAME} in a map become secret references.
+func parseEnv(raw interface{}) (map[string]string, error) {
+	switch raw := raw.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		result := make(map[string]string)
+
+		for i, v := range raw {
+			item, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("env[%d]: expected a KEY=VALUE string, got %v", i, v)
+			}
+
+			key, value, hasValue := strings.Cut(item, "=")
+			key = strings.TrimSpace(key)
+
+			if key == "" {
+				return nil, fmt.Errorf("env[%d]: missing key in %q", i, item)
+			}
+
+			// only key exists. set value from env
+			if !hasValue {
+				result[key] = env(key, "")
+				continue
+			}
+
+			result[key] = strings.TrimSpace(value)
 		}
 
-		if len(value) > 0 {
-			result[key] = strings.TrimSpace(value[0])
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]string, len(raw))
+
+		for key, v := range raw {
+			switch value := v.(type) {
+			case nil:
+				result[key] = env(key, "")
+			case string:
+				result[key] = value
+			case bool:
+				result[key] = strconv.FormatBool(value)
+			case float64:
+				// the config is decoded as float64, which rounds large integers
+				if value == math.Trunc(value) && math.Abs(value) > maxExactInteger {
+					return nil, fmt.Errorf("%s: number %v can't be represented exactly, quote it", key, v)
+				}
+				result[key] = strconv.FormatFloat(value, 'f', -1, 64)
+			case map[string]interface{}:
+				name, ok := value["secret"].(string)
+				if !ok || name == "" || len(value) != 1 {
+					return nil, fmt.Errorf("%s: expected a secret reference like {secret: NAME}, got %v", key, v)
+				}
+				result[key] = secretPrefix + name
+			default:
+				return nil, fmt.Errorf("%s: expected a string, number or boolean, got %v", key, v)
+			}
 		}
+
+		return result, nil
 	}
 
-	return result, nil
+	return nil, fmt.Errorf("expected a list of KEY=VALUE strings or a map, got %v", raw)
 }
 
-func getPluginName(s string) string {
-	ref := s
-	if strings.HasPrefix(ref, "github.com/") && !strings.Contains(ref, "://") {
-		ref = "https://" + ref
+// escapeEnv escapes the $ of the env values of step so that they are
+// not interpolated on upload.
+func escapeEnv(step *Step) {
+	for _, env := range []map[string]string{step.Env, step.Build.Env} {
+		for key, value := range env {
+			env[key] = escapeInterpolation(value)
+		}
 	}
+}
 
-	u, err := url.Parse(ref)
-	// if URL could not be parsed, assume it is a direct reference
-	if err != nil {
-		return s
+// scpReference matches the scp-like form of git references, such as
+// git@github.com:org/repo.git
+var scpReference = regexp.MustCompile(`^[\w.-]+@[\w.-]+:`)
+
+// isPluginReference reports whether the plugin reference s, in any of
+// the forms Buildkite accepts, names this plugin. The org or the
+// location of the repository does not matter so that forks match, but
+// the name of the repository must be exactly that of the plugin, with
+// or without the -buildkite-plugin suffix.
+func isPluginReference(s string) bool {
+	ref, _, _ := strings.Cut(s, "#")
+
+	if loc := scpReference.FindStringIndex(ref); loc != nil {
+		ref = ref[loc[1]:]
+	} else {
+		u, err := url.Parse(ref)
+		// if URL could not be parsed, it is not a valid reference
+		if err != nil {
+			return false
+		}
+		ref = u.Path
 	}
 
-	// remove the org from the path
-	_, repo := path.Split(u.Path)
-	return repo
+	name := path.Base(strings.TrimRight(ref, "/"))
+	name = strings.TrimSuffix(name, ".git")
+	name = strings.TrimSuffix(name, "-buildkite-plugin")
+
+	return name == pluginName
 }
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func defaultPlugin() Plugin {
@@ -166,6 +173,7 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 		}
 	}]`
 
+	logs := captureLog(t)
 	got, _ := initializePlugin(param)
 
 	expected := Plugin{
@@ -271,6 +279,15 @@ func TestPluginShouldUnmarshallCorrectly(t *testing.T) {
 	if diff := cmp.Diff(expected, got); diff != "" {
 		t.Fatalf("plugin diff (-want +got): \n%s", diff)
 	}
+
+	for _, warning := range []string{
+		"notify[0]: email notifications are not supported on steps and are dropped",
+		"notify[1]: email notifications are not supported on steps and are dropped",
+		"notify[3]: webhook notifications are not supported on steps and are dropped",
+		"notify[4]: pagerduty_change_event notifications are not supported on steps and are dropped",
+	} {
+		assert.Contains(t, logs.String(), warning)
+	}
 }
 
 func TestPluginShouldOnlyFullyUnmarshallItselfAndNotOtherPlugins(t *testing.T) {
@@ -299,7 +316,7 @@ func TestPluginShouldErrorIfPluginConfigIsInvalid(t *testing.T) {
 		{
 			"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
 				"env": {
-					"anInvalidKey": "An Invalid Value"
+					"anInvalidKey": {"nested": "An Invalid Value"}
 				},
 				"watch": [
 					{
@@ -317,7 +334,181 @@ func TestPluginShouldErrorIfPluginConfigIsInvalid(t *testing.T) {
 	]
 	`
 	_, err := initializePlugin(param)
-	assert.Error(t, err)
+	assert.EqualError(t, err, "failed to parse plugin configuration: env: anInvalidKey: expected a secret reference like {secret: NAME}, got map[nested:An Invalid Value]")
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("FROM_ENV", "from env")
+
+	testCases := map[string]struct {
+		Raw      interface{}
+		Expected map[string]string
+		Error    string
+	}{
+		"none": {Raw: nil, Expected: nil},
+		"list": {
+			Raw:      []interface{}{"A=1", " B = two ", "FROM_ENV", "EMPTY="},
+			Expected: map[string]string{"A": "1", "B": "two", "FROM_ENV": "from env", "EMPTY": ""},
+		},
+		"equals in value": {
+			Raw:      []interface{}{"URL=https://example.com/?a=b&c=d", "GOFLAGS=-mod=mod"},
+			Expected: map[string]string{"URL": "https://example.com/?a=b&c=d", "GOFLAGS": "-mod=mod"},
+		},
+		"map": {
+			Raw: map[string]interface{}{
+				"A":        "1",
+				"URL":      "a=b",
+				"COUNT":    float64(3),
+				"RATIO":    float64(0.5),
+				"DEBUG":    true,
+				"FROM_ENV": nil,
+				"SPACED":   " kept ",
+			},
+			Expected: map[string]string{
+				"A":        "1",
+				"URL":      "a=b",
+				"COUNT":    "3",
+				"RATIO":    "0.5",
+				"DEBUG":    "true",
+				"FROM_ENV": "from env",
+				"SPACED":   " kept ",
+			},
+		},
+		"large number": {
+			Raw:   map[string]interface{}{"ACCOUNT": float64(123456789012345678901)},
+			Error: "ACCOUNT: number 1.2345678901234568e+20 can't be represented exactly, quote it",
+		},
+		"non-string item": {
+			Raw:   []interface{}{"A=1", float64(2)},
+			Error: "env[1]: expected a KEY=VALUE string, got 2",
+		},
+		"missing key": {
+			Raw:   []interface{}{"=value"},
+			Error: `env[0]: missing key in "=value"`,
+		},
+		"invalid map value": {
+			Raw:   map[string]interface{}{"LIST": []interface{}{"a"}},
+			Error: "LIST: expected a string, number or boolean, got [a]",
+		},
+		"invalid type": {
+			Raw:   "A=1",
+			Error: "expected a list of KEY=VALUE strings or a map, got A=1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseEnv(tc.Raw)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestPluginWithEnvMaps(t *testing.T) {
+	param := `[{
+		"monorepo-diff#v1.2.0": {
+			"env": {"DEPLOY_URL": "https://example.com/?a=b", "RETRIES": 3},
+			"upload_env": {"BUILDKITE_AGENT_DEBUG": true},
+			"watch": [
+				{
+					"path": "service-a/",
+					"config": {
+						"command": "make deploy",
+						"env": {"SERVICE": "a"}
+					}
+				},
+				{
+					"path": "service-b/",
+					"config": {
+						"trigger": "service-b",
+						"build": {"env": {"SERVICE": "b"}}
+					}
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"BUILDKITE_AGENT_DEBUG": "true"}, got.UploadEnv)
+	assert.Equal(t, map[string]string{
+		"DEPLOY_URL": "https://example.com/?a=b",
+		"RETRIES":    "3",
+		"SERVICE":    "a",
+	}, got.Watch[0].Step.Env)
+	assert.Equal(t, map[string]string{
+		"DEPLOY_URL": "https://example.com/?a=b",
+		"RETRIES":    "3",
+		"SERVICE":    "b",
+	}, got.Watch[1].Step.Build.Env)
+}
+
+func TestPluginWithInvalidStepEnv(t *testing.T) {
+	testCases := map[string]struct {
+		Config string
+		Error  string
+	}{
+		"step env": {
+			Config: `{"watch": [{"path": "a/", "config": {"command": "make", "env": ["A=1", {"B": 2}]}}]}`,
+			Error:  "watch[0]: env: env[1]: expected a KEY=VALUE string, got map[B:2]",
+		},
+		"build env": {
+			Config: `{"watch": [{"path": "a/", "config": {"trigger": "a", "build": {"env": {"B": ["2"]}}}}]}`,
+			Error:  "watch[0]: build: env: B: expected a string, number or boolean, got [2]",
+		},
+		"upload env": {
+			Config: `{"upload_env": "A=1"}`,
+			Error:  "upload_env: expected a list of KEY=VALUE strings or a map, got A=1",
+		},
+		"unmatched trigger env": {
+			Config: `{"unmatched": {"trigger": {"command": "make", "env": [1]}}}`,
+			Error:  "unmatched: trigger: env: env[0]: expected a KEY=VALUE string, got 1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := initializePlugin(`[{"monorepo-diff#v1.2.0": ` + tc.Config + `}]`)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+tc.Error)
+		})
+	}
+}
+
+func TestPluginEscapeEnv(t *testing.T) {
+	param := `[{
+		"monorepo-diff#v1.2.0": {
+			"escape_env": true,
+			"interpolation": %t,
+			"env": ["PASSWORD=pa$$word"],
+			"watch": [
+				{
+					"path": "service-a/",
+					"config": {"trigger": "service-a", "build": {"env": {"PRICE": "$5"}}}
+				}
+			],
+			"unmatched": {"trigger": {"command": "make", "env": {"HOME_DIR": "$HOME"}}}
+		}
+	}]`
+
+	got, err := initializePlugin(fmt.Sprintf(param, true))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"PASSWORD": "pa$$$$word", "PRICE": "$$5"}, got.Watch[0].Step.Build.Env)
+	assert.Equal(t, map[string]string{"PASSWORD": "pa$$$$word", "HOME_DIR": "$$HOME"}, got.Unmatched.Step.Env)
+	assert.Equal(t, map[string]string{"PASSWORD": "pa$$word"}, got.Env)
+
+	got, err = initializePlugin(fmt.Sprintf(param, false))
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"PASSWORD": "pa$$word", "PRICE": "$5"}, got.Watch[0].Step.Build.Env)
 }
 
 func TestPluginFullDifferentOrg(t *testing.T) {
@@ -356,6 +547,136 @@ func TestPluginInvalidReference(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestIsPluginReference(t *testing.T) {
+	testCases := map[string]bool{
+		"monorepo-diff":                                                             true,
+		"monorepo-diff#v1.2.0":                                                      true,
+		"monorepo-diff-buildkite-plugin#v1.2":                                       true,
+		"random-org/monorepo-diff#v1.2.0":                                           true,
+		"random-org/monorepo-diff-buildkite-plugin#commit":                          true,
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#v1.2.0":        true,
+		"github.com/random-org/monorepo-diff-buildkite-plugin":                      true,
+		"https://github.com/random-org/monorepo-diff-buildkite-plugin.git#v1.2.0":   true,
+		"ssh://git@github.com/random-org/monorepo-diff-buildkite-plugin.git#v1.2.0": true,
+		"git@github.com:random-org/monorepo-diff-buildkite-plugin.git#v1.2.0":       true,
+		"git@gitlab.example.com:ci/plugins/monorepo-diff.git":                       true,
+		"file:///var/lib/buildkite-agent/plugins/monorepo-diff-buildkite-plugin":    true,
+		"file:///tmp/monorepo-diff-buildkite-plugin/#main":                          true,
+		"./.buildkite/plugins/monorepo-diff":                                        true,
+		"../monorepo-diff-buildkite-plugin":                                         true,
+		"/plugins/monorepo-diff/":                                                   true,
+		"monorepo-diff-extra#v1.0.0":                                                false,
+		"github.com/random-org/monorepo-diff-extra-buildkite-plugin#v1.0.0":         false,
+		"github.com/random-org/my-monorepo-diff-buildkite-plugin#v1.0.0":            false,
+		"github.com/monorepo-diff/docker-buildkite-plugin#v1.0.0":                   false,
+		"docker#v5.9.0":               false,
+		":invalid/monorepo-diff#v1.2": false,
+	}
+
+	for ref, expected := range testCases {
+		t.Run(ref, func(t *testing.T) {
+			assert.Equal(t, expected, isPluginReference(ref))
+		})
+	}
+}
+
+func TestPluginIgnoresSimilarlyNamedPlugins(t *testing.T) {
+	param := `[
+		{"monorepo-diff-extra#v1.0.0": {"diff": "echo extra"}},
+		{"monorepo-diff#v1.2.0": {"diff": "echo monorepo-diff"}}
+	]`
+
+	got, err := initializePlugins(param)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, "echo monorepo-diff", got[0].Diff)
+}
+
+func TestPluginInstanceSelection(t *testing.T) {
+	param := `[
+		{"monorepo-diff#v1.2.0": {"diff": "echo first"}},
+		{"monorepo-diff#v1.2.0": {"id": "docs", "diff": "echo docs"}},
+		{"monorepo-diff#v1.2.0": {"id": "2", "diff": "echo third"}}
+	]`
+
+	testCases := map[string]struct {
+		Instance string
+		Expected string
+		Error    string
+	}{
+		"index":            {Instance: "0", Expected: "echo first"},
+		"id":               {Instance: "docs", Expected: "echo docs"},
+		"id before index":  {Instance: "2", Expected: "echo third"},
+		"index of id":      {Instance: "1", Expected: "echo docs"},
+		"unknown id":       {Instance: "services", Error: `MONOREPO_DIFF_INSTANCE: no instance with id or index "services"`},
+		"index over count": {Instance: "3", Error: `MONOREPO_DIFF_INSTANCE: no instance with id or index "3"`},
+		"negative index":   {Instance: "-1", Error: `MONOREPO_DIFF_INSTANCE: no instance with id or index "-1"`},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(instanceEnv, tc.Instance)
+
+			got, err := initializePlugins(param)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				assert.Equal(t, 2, exitCode(err))
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, got, 1)
+			assert.Equal(t, tc.Expected, got[0].Diff)
+		})
+	}
+}
+
+func TestPluginDuplicateInstanceID(t *testing.T) {
+	param := `[
+		{"monorepo-diff#v1.2.0": {"id": "docs"}},
+		{"monorepo-diff#v1.2.0": {}},
+		{"monorepo-diff#v1.2.0": {"id": "docs"}}
+	]`
+
+	_, err := initializePlugins(param)
+	assert.EqualError(t, err, "instance 2: id docs is already used by instance 0")
+}
+
+func TestPluginInstanceNames(t *testing.T) {
+	got, err := initializePlugins(`[
+		{"monorepo-diff#v1.2.0": {}},
+		{"monorepo-diff#v1.2.0": {"id": "docs"}}
+	]`)
+	require.NoError(t, err)
+	assert.Equal(t, "0", got[0].Instance)
+	assert.Equal(t, "docs", got[1].Instance)
+
+	single, err := initializePlugins(`[{"monorepo-diff#v1.2.0": {"id": "docs"}}]`)
+	require.NoError(t, err)
+	assert.Equal(t, "", single[0].Instance)
+}
+
+func TestPluginMergedInstancesWithDifferentUploadOptions(t *testing.T) {
+	param := `[
+		{"monorepo-diff#v1.2.0": {"merge": true, "notify": [{"email": "a@example.com"}], "hooks": [{"command": "echo a"}]}},
+		{"monorepo-diff#v1.2.0": {"wait": true}},
+		{"monorepo-diff#v1.2.0": {"merge": true, "notify": [{"email": "b@example.com"}], "hooks": [{"command": "echo b"}]}}
+	]`
+
+	_, err := initializePlugins(param)
+	require.NoError(t, err)
+
+	param = `[
+		{"monorepo-diff#v1.2.0": {"merge": true}},
+		{"monorepo-diff#v1.2.0": {"merge": true, "wait": true}}
+	]`
+
+	_, err = initializePlugins(param)
+	assert.EqualError(t, err, "instance 1: wait must be the same as in instance 0 to merge their steps")
+	assert.Equal(t, 2, exitCode(err))
+}
+
 func TestPluginDefaultCommand(t *testing.T) {
 	param := `[
 		{
@@ -418,6 +739,243 @@ func TestPluginDefaultConfigCommand(t *testing.T) {
 	assert.Equal(t, defaultPluginWithDefault(), got)
 }
 
+func TestPluginWithDefaultList(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{
+					"path": "app/",
+					"config": {"trigger": "app-deploy"}
+				},
+				{
+					"default": [
+						{"command": "make smoke-test"},
+						{"config": {"trigger": "integration-tests"}}
+					]
+				},
+				{
+					"default": {"command": "make security-scan"},
+					"default_mode": "always"
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+
+	expected := defaultPlugin()
+	expected.Watch = []WatchConfig{
+		{
+			Paths: []string{"app/"},
+			Step: Step{
+				Trigger: "app-deploy",
+				Build: Build{
+					Message: "fix: temp file not correctly deleted",
+					Branch:  "go-rewrite",
+					Commit:  "123",
+				},
+			},
+		},
+		{
+			Default: true,
+			Paths:   []string{},
+			Step:    Step{Command: "make smoke-test"},
+		},
+		{
+			Default: true,
+			Paths:   []string{},
+			Step: Step{
+				Trigger: "integration-tests",
+				Build: Build{
+					Message: "fix: temp file not correctly deleted",
+					Branch:  "go-rewrite",
+					Commit:  "123",
+				},
+			},
+		},
+		{
+			Default:     true,
+			DefaultMode: defaultModeAlways,
+			Paths:       []string{},
+			Step:        Step{Command: "make security-scan"},
+		},
+	}
+
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Fatalf("plugin diff (-want +got):\n%s", diff)
+	}
+}
+
+func TestPluginInvalidDefault(t *testing.T) {
+	testCases := map[string]struct {
+		Watch string
+		Error string
+	}{
+		"default list item": {
+			Watch: `{"path": "app/"}, {"default": ["make test"]}`,
+			Error: "failed to parse plugin configuration: watch[1]: default: expected a list of steps",
+		},
+		"default_mode": {
+			Watch: `{"default": [{"command": "make lint"}, {"command": "make test"}], "default_mode": "sometimes"}`,
+			Error: "failed to parse plugin configuration: watch[0]: default_mode: expected fallback or always, got sometimes",
+		},
+		"default_mode without default": {
+			Watch: `{"default": [{"command": "make lint"}, {"command": "make test"}]}, {"path": "app/", "default_mode": "always"}`,
+			Error: "failed to parse plugin configuration: watch[1]: default_mode is only valid with default",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"watch": [` + tc.Watch + `]
+				}
+			}]`
+
+			_, err := initializePlugin(param)
+			assert.EqualError(t, err, tc.Error)
+		})
+	}
+}
+
+func TestPluginWithWatchFile(t *testing.T) {
+	testCases := map[string]struct {
+		Name    string
+		Content string
+	}{
+		"yaml list": {
+			Name: "watch.yml",
+			Content: `
+- path: service-a/
+  config:
+    trigger: deploy-service-a
+- default:
+    command: make smoke-test
+`,
+		},
+		"yaml map": {
+			Name: "watch.yml",
+			Content: `
+watch:
+  - path: [service-a/]
+    config:
+      trigger: deploy-service-a
+  - default:
+      command: make smoke-test
+`,
+		},
+		"json": {
+			Name: "watch.json",
+			Content: `[
+	{"path": "service-a/", "config": {"trigger": "deploy-service-a"}},
+	{"default": {"command": "make smoke-test"}}
+]`,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), tc.Name)
+			require.NoError(t, os.WriteFile(file, []byte(tc.Content), 0o644))
+
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"env": ["env1=env-1"],
+					"watch_file": "` + file + `",
+					"watch": [{"path": "docs/", "config": {"command": "make docs"}}]
+				}
+			}]`
+
+			got, err := initializePlugin(param)
+			require.NoError(t, err)
+
+			build := Build{
+				Message: "fix: temp file not correctly deleted",
+				Branch:  "go-rewrite",
+				Commit:  "123",
+				Env:     map[string]string{"env1": "env-1"},
+			}
+
+			assert.Equal(t, []string{"docs/"}, got.Watch[0].Paths)
+			assert.Equal(t, Step{Command: "make docs", Env: map[string]string{"env1": "env-1"}}, got.Watch[0].Step)
+			assert.Equal(t, []string{"service-a/"}, got.Watch[1].Paths)
+			assert.Equal(t, Step{Trigger: "deploy-service-a", Build: build}, got.Watch[1].Step)
+			assert.Equal(t, true, got.Watch[2].Default)
+			assert.Equal(t, Step{Command: "make smoke-test", Env: map[string]string{"env1": "env-1"}}, got.Watch[2].Step)
+		})
+	}
+}
+
+func TestPluginWithInvalidWatchFile(t *testing.T) {
+	dir := t.TempDir()
+
+	testCases := map[string]struct {
+		Content string
+		Error   string
+	}{
+		"invalid yaml": {
+			Content: "- path: [service-a/\n",
+			Error:   "watch_file: %s: yaml: line 1: did not find expected ',' or ']'",
+		},
+		"not a list": {
+			Content: "path: service-a/\n",
+			Error:   "watch_file: %s:1: expected a watch key",
+		},
+		"invalid path": {
+			Content: "- path: service-a/\n- path: [service-b/, 1]\n",
+			Error:   "%s:2: watch[1]: path: expected a string, got 1",
+		},
+		"invalid when": {
+			Content: "watch:\n  - path: service-a/\n\n  - path: service-b/\n    when: changes.count\n",
+			Error:   "%s:4: watch[1]: when: expression is a number, expected a bool",
+		},
+		"invalid entry": {
+			Content: "- service-a/\n",
+			Error:   "%s:1: watch[0]: json: cannot unmarshal string into Go value of type main.WatchConfig",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(name, " ", "-")+".yml")
+			require.NoError(t, os.WriteFile(file, []byte(tc.Content), 0o644))
+
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"watch_file": "` + file + `"
+				}
+			}]`
+
+			_, err := initializePlugin(param)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+fmt.Sprintf(tc.Error, file))
+		})
+	}
+}
+
+func TestPluginWithMissingWatchFile(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch_file": "missing.yml"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: watch_file: open missing.yml: no such file or directory")
+}
+
+func TestPluginWithInvalidPath(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [{"path": "app/", "skip_path": ["app/docs", {"glob": "*.md"}]}]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: watch[0]: skip_path: expected a string, got map[glob:*.md]")
+}
+
 func TestPluginWithBuildMetadata(t *testing.T) {
 	param := `[{
         "github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
@@ -471,3 +1029,707 @@ func TestPluginWithBuildMetadata(t *testing.T) {
 		t.Fatalf("plugin diff (-want +got): \n%s", diff)
 	}
 }
+
+func TestPluginUnmatched(t *testing.T) {
+	testCases := map[string]struct {
+		Config   string
+		Expected UnmatchedConfig
+	}{
+		"warn": {
+			Config:   `"warn"`,
+			Expected: UnmatchedConfig{Policy: unmatchedWarn},
+		},
+		"fail": {
+			Config:   `"fail"`,
+			Expected: UnmatchedConfig{Policy: unmatchedFail},
+		},
+		"trigger pipeline": {
+			Config: `{ "trigger": "catch-all" }`,
+			Expected: UnmatchedConfig{
+				Policy: unmatchedTrigger,
+				Step: &Step{
+					Trigger: "catch-all",
+					Build: Build{
+						Message: "fix: temp file not correctly deleted",
+						Branch:  "go-rewrite",
+						Commit:  "123",
+						Env:     map[string]string{"env1": "env-1"},
+					},
+				},
+			},
+		},
+		"trigger step": {
+			Config: `{ "trigger": { "command": "echo unmatched", "label": "unmatched" } }`,
+			Expected: UnmatchedConfig{
+				Policy: unmatchedTrigger,
+				Step: &Step{
+					Command: "echo unmatched",
+					Label:   "unmatched",
+					Env:     map[string]string{"env1": "env-1"},
+				},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"env": [ "env1=env-1" ],
+					"unmatched": ` + tc.Config + `
+				}
+			}]`
+
+			got, err := initializePlugin(param)
+			assert.NoError(t, err)
+
+			if diff := cmp.Diff(tc.Expected, got.Unmatched); diff != "" {
+				t.Fatalf("unmatched diff (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPluginInvalidUnmatched(t *testing.T) {
+	for _, config := range []string{`"sometimes"`, `{ "trigger": 1 }`, `true`} {
+		param := `[{
+			"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+				"unmatched": ` + config + `
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestPluginOutput(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"output": "-",
+			"upload": false
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, "-", got.Output)
+	assert.True(t, got.SkipUpload)
+}
+
+func TestPluginOutputWithoutArtifactPath(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"output": "artifact:"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.Error(t, err)
+}
+
+func TestPluginInvalidFormat(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"format": "toml"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: format: expected yaml or json, got toml")
+	assert.Equal(t, 2, exitCode(err))
+}
+
+func TestPluginOnDiffFailure(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"on_diff_failure": "trigger_all"
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, diffFailureTriggerAll, got.OnDiffFailure)
+}
+
+func TestPluginInvalidOnDiffFailure(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"on_diff_failure": "ignore"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: on_diff_failure: expected one of fail, trigger_all, trigger_default or skip, got ignore")
+}
+
+func TestPluginDeepen(t *testing.T) {
+	testCases := map[string]struct {
+		Config   string
+		Expected *DeepenConfig
+		Error    string
+	}{
+		"defaults": {
+			Config:   `{}`,
+			Expected: &DeepenConfig{MaxDepth: 1000, Step: 50, Remote: "origin"},
+		},
+		"custom": {
+			Config:   `{"max_depth": 200, "step": 20, "remote": "upstream", "merge_base": "upstream/main"}`,
+			Expected: &DeepenConfig{MaxDepth: 200, Step: 20, Remote: "upstream", MergeBase: "upstream/main"},
+		},
+		"negative step": {
+			Config: `{"step": -1}`,
+			Error:  "failed to parse plugin configuration: deepen: step must not be negative",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"deepen": ` + tc.Config + `
+				}
+			}]`
+
+			got, err := initializePlugin(param)
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got.Deepen)
+		})
+	}
+}
+
+func TestPluginForceAll(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"force_all": {
+				"message": "[ci all]",
+				"env": "FORCE_ALL",
+				"meta_data": "force-all",
+				"branches": ["release/*"]
+			},
+			"watch": [
+				{
+					"id": "service-a",
+					"path": "service-a/",
+					"config": {"command": "echo a"}
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, ForceAllConfig{
+		Message:  "[ci all]",
+		Env:      "FORCE_ALL",
+		MetaData: "force-all",
+		Branches: []string{"release/*"},
+	}, got.ForceAll)
+	assert.Equal(t, "service-a", got.Watch[0].ID)
+}
+
+func TestPluginInvalidForceAllBranch(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"force_all": {"branches": ["release/["]}
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: force_all: branches: invalid pattern release/[")
+}
+
+func TestPluginWatchBranchesAndTags(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{
+					"path": "service-a/",
+					"branches": ["main", "release/*"],
+					"tags": "v*",
+					"config": {"trigger": "deploy-service-a"}
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"main", "release/*"}, got.Watch[0].Branches)
+	assert.Equal(t, []string{"v*"}, got.Watch[0].Tags)
+	assert.Nil(t, got.Watch[0].RawBranches)
+	assert.Nil(t, got.Watch[0].RawTags)
+}
+
+func TestPluginInvalidWatchBranches(t *testing.T) {
+	testCases := map[string]struct {
+		Branches string
+		Error    string
+	}{
+		"not a string": {
+			Branches: `["main", 1]`,
+			Error:    "failed to parse plugin configuration: watch[0]: branches: expected a string, got 1",
+		},
+		"invalid pattern": {
+			Branches: `"release/["`,
+			Error:    "failed to parse plugin configuration: watch[0]: invalid pattern release/[",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			param := `[{
+				"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+					"watch": [{"path": "service-a/", "branches": ` + tc.Branches + `}]
+				}
+			}]`
+
+			_, err := initializePlugin(param)
+			assert.EqualError(t, err, tc.Error)
+		})
+	}
+}
+
+func TestPluginWatchWhen(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{
+					"path": "service-a/",
+					"when": "build.source == \"schedule\" || env.DEPLOY == \"1\"",
+					"config": {"trigger": "deploy-service-a"}
+				},
+				{
+					"path": "service-b/",
+					"when": "changes.count > \"10\"",
+					"config": {"trigger": "deploy-service-b"}
+				}
+			]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: watch[1]: when: > expects numbers, got a number and a string")
+}
+
+func TestPluginWatchWhenIsParsedOnce(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"watch": [
+				{"path": "service-a/", "when": "changes.matched > 0", "config": {"trigger": "service-a"}},
+				{"path": "service-b/", "config": {"trigger": "service-b"}}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+	assert.NotNil(t, got.Watch[0].Condition)
+	assert.Nil(t, got.Watch[1].Condition)
+
+	watch, err := withMatchingCondition(got.Watch, []string{"service-a/main.go"})
+	require.NoError(t, err)
+	assert.Len(t, watch, 2)
+}
+
+func TestPluginSigning(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"signing": {
+				"jwks_file": "/etc/buildkite-agent/jwks.json",
+				"jwks_key_id": "my-key"
+			}
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, SigningConfig{JWKSFile: "/etc/buildkite-agent/jwks.json", JWKSKeyID: "my-key"}, got.Signing)
+}
+
+func TestPluginSigningWithoutJWKSFile(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"signing": { "jwks_key_id": "my-key" }
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.Error(t, err)
+}
+
+func TestPluginUploadOptions(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"replace": true,
+			"reject_secrets": true,
+			"agent_path": "/usr/local/bin/buildkite-agent",
+			"upload_env": [ "BUILDKITE_AGENT_DEBUG=true" ]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.True(t, got.Replace)
+	assert.True(t, got.RejectSecrets)
+	assert.Equal(t, "/usr/local/bin/buildkite-agent", got.agent())
+	assert.Equal(t, map[string]string{"BUILDKITE_AGENT_DEBUG": "true"}, got.UploadEnv)
+}
+
+func TestPluginIncompatibleUploadOptions(t *testing.T) {
+	testCases := map[string]Plugin{
+		"replace without upload":        {SkipUpload: true, Replace: true},
+		"reject_secrets without upload": {SkipUpload: true, RejectSecrets: true},
+		"dry_run without upload":        {SkipUpload: true, DryRun: true},
+		"signing without upload":        {SkipUpload: true, Signing: SigningConfig{JWKSFile: "jwks.json"}},
+		"dry_run with replace":          {DryRun: true, Replace: true},
+	}
+
+	for name, plugin := range testCases {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, plugin.validateUpload())
+		})
+	}
+
+	assert.NoError(t, Plugin{DryRun: true, RejectSecrets: true}.validateUpload())
+}
+
+func TestPluginTimeouts(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"diff_timeout": "10m",
+			"upload_timeout": "30s",
+			"upload_retries": 3,
+			"upload_retry_backoff": "1s"
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, got.DiffTimeout)
+	assert.Equal(t, 30*time.Second, got.UploadTimeout)
+	assert.Equal(t, 3, got.UploadRetries)
+	assert.Equal(t, time.Second, got.UploadRetryBackoff)
+	assert.Equal(t, "", got.RawDiffTimeout)
+}
+
+func TestPluginInvalidTimeouts(t *testing.T) {
+	for _, config := range []string{
+		`"diff_timeout": "ten minutes"`,
+		`"upload_timeout": "-1s"`,
+		`"upload_retries": -1`,
+	} {
+		param := `[{
+			"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+				` + config + `
+			}
+		}]`
+
+		_, err := initializePlugin(param)
+		assert.Error(t, err, config)
+	}
+}
+
+func TestPluginWithSeveralInstances(t *testing.T) {
+	param := `[
+		{
+			"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+				"diff": "git diff --name-only origin/main",
+				"watch": [{"path": "service-a/", "config": {"trigger": "service-a"}}]
+			}
+		},
+		{
+			"github.com/example/example-plugin#commit": {}
+		},
+		{
+			"monorepo-diff#v1.2.0": {
+				"merge": true,
+				"watch": [{"path": "docs/", "config": {"command": "make docs"}}]
+			}
+		}
+	]`
+
+	got, err := initializePlugins(param)
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+
+	assert.Equal(t, "git diff --name-only origin/main", got[0].Diff)
+	assert.False(t, got[0].Merge)
+	assert.Equal(t, []string{"service-a/"}, got[0].Watch[0].Paths)
+
+	assert.Equal(t, defaultDiff, got[1].Diff)
+	assert.True(t, got[1].Merge)
+	assert.Equal(t, []string{"docs/"}, got[1].Watch[0].Paths)
+
+	first, err := initializePlugin(param)
+	require.NoError(t, err)
+	assert.Equal(t, got[0], first)
+}
+
+func TestPluginWithInvalidSecondInstance(t *testing.T) {
+	param := `[
+		{"monorepo-diff#v1.2.0": {}},
+		{"monorepo-diff#v1.2.0": {"format": "xml"}}
+	]`
+
+	_, err := initializePlugins(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: instance 1: format: expected yaml or json, got xml")
+}
+
+func TestPluginEnvPrecedence(t *testing.T) {
+	watch := `[
+		{"path": "a/", "config": {"command": "make", "env": ["DEPLOY_ENV=staging"]}},
+		{"path": "b/", "config": {"trigger": "b", "build": {"env": {"DEPLOY_ENV": "staging"}}}},
+		{"path": "c/", "config": {"command": "make", "env": {"A": "1"}, "inherit_env": false}},
+		{"path": "d/", "config": {"trigger": "d", "inherit_env": false}}
+	]`
+
+	testCases := map[string]struct {
+		Options  string
+		Expected [][]map[string]string
+	}{
+		"plugin wins by default": {
+			Options: `{}`,
+			Expected: [][]map[string]string{
+				{{"DEPLOY_ENV": "production", "REGION": "eu"}, nil},
+				{nil, {"DEPLOY_ENV": "production", "REGION": "eu"}},
+				{{"A": "1"}, nil},
+				{nil, nil},
+			},
+		},
+		"step wins": {
+			Options: `{"env_merge": "step_wins"}`,
+			Expected: [][]map[string]string{
+				{{"DEPLOY_ENV": "staging", "REGION": "eu"}, nil},
+				{nil, {"DEPLOY_ENV": "staging", "REGION": "eu"}},
+				{{"A": "1"}, nil},
+				{nil, nil},
+			},
+		},
+		"command steps only": {
+			Options: `{"env_target": "command"}`,
+			Expected: [][]map[string]string{
+				{{"DEPLOY_ENV": "production", "REGION": "eu"}, nil},
+				{nil, {"DEPLOY_ENV": "staging"}},
+				{{"A": "1"}, nil},
+				{nil, nil},
+			},
+		},
+		"triggers only": {
+			Options: `{"env_target": "trigger", "env_merge": "plugin_wins"}`,
+			Expected: [][]map[string]string{
+				{{"DEPLOY_ENV": "staging"}, nil},
+				{nil, {"DEPLOY_ENV": "production", "REGION": "eu"}},
+				{{"A": "1"}, nil},
+				{nil, nil},
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var options map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(tc.Options), &options))
+			options["env"] = []string{"DEPLOY_ENV=production", "REGION=eu"}
+			options["watch"] = json.RawMessage(watch)
+
+			config, err := json.Marshal([]map[string]interface{}{{"monorepo-diff#v1.2.0": options}})
+			require.NoError(t, err)
+
+			got, err := initializePlugin(string(config))
+			require.NoError(t, err)
+
+			for i, expected := range tc.Expected {
+				assert.Equal(t, expected[0], got.Watch[i].Step.Env, "step env of watch[%d]", i)
+				assert.Equal(t, expected[1], got.Watch[i].Step.Build.Env, "build env of watch[%d]", i)
+			}
+		})
+	}
+}
+
+func TestPluginInvalidEnvPrecedence(t *testing.T) {
+	testCases := map[string]struct {
+		Config string
+		Error  string
+	}{
+		"env_merge": {
+			Config: `{"env_merge": "merge"}`,
+			Error:  "env_merge: expected plugin_wins or step_wins, got merge",
+		},
+		"env_target": {
+			Config: `{"env_target": "group"}`,
+			Error:  "env_target: expected both, command or trigger, got group",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := initializePlugin(`[{"monorepo-diff#v1.2.0": ` + tc.Config + `}]`)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+tc.Error)
+		})
+	}
+}
+
+func TestParseNotification(t *testing.T) {
+	testCases := map[string]struct {
+		Raw      interface{}
+		Expected PluginNotify
+		Error    string
+	}{
+		"slack channel": {
+			Raw:      map[string]interface{}{"slack": "#ci", "if": "build.state == \"failed\""},
+			Expected: PluginNotify{Slack: "#ci", Condition: "build.state == \"failed\""},
+		},
+		"slack object": {
+			Raw: map[string]interface{}{"slack": map[string]interface{}{
+				"channels": []interface{}{"#ci", "@someuser"},
+				"message":  "Deployed",
+			}},
+			Expected: PluginNotify{Slack: SlackNotification{Channels: []string{"#ci", "@someuser"}, Message: "Deployed"}},
+		},
+		"github check": {
+			Raw:      map[string]interface{}{"github_check": map[string]interface{}{"context": "monorepo"}},
+			Expected: PluginNotify{GithubCheck: GithubStatusNotification{Context: "monorepo"}},
+		},
+		"github check string": {
+			Raw:      "github_check",
+			Expected: PluginNotify{Simple: "github_check"},
+		},
+		"github commit status string": {
+			Raw:      "github_commit_status",
+			Expected: PluginNotify{Simple: "github_commit_status"},
+		},
+		"email": {
+			Raw:      map[string]interface{}{"email": "dev@example.com"},
+			Expected: PluginNotify{Email: "dev@example.com"},
+		},
+		"pagerduty": {
+			Raw:      map[string]interface{}{"pagerduty_change_event": "key"},
+			Expected: PluginNotify{PagerDuty: "key"},
+		},
+		"webhook": {
+			Raw:      map[string]interface{}{"webhook": "https://example.com"},
+			Expected: PluginNotify{Webhook: "https://example.com"},
+		},
+		"unknown type": {
+			Raw:   map[string]interface{}{"teams": "#ci"},
+			Error: "unknown notification type teams",
+		},
+		"unknown string": {
+			Raw:   "slack",
+			Error: "unknown notification slack",
+		},
+		"several types": {
+			Raw:   map[string]interface{}{"slack": "#ci", "email": "dev@example.com"},
+			Error: "expected a single notification, got email, slack",
+		},
+		"condition only": {
+			Raw:   map[string]interface{}{"if": "build.state == \"failed\""},
+			Error: "missing notification type",
+		},
+		"invalid condition": {
+			Raw:   map[string]interface{}{"slack": "#ci", "if": true},
+			Error: "if: expected a string, got true",
+		},
+		"slack without channels": {
+			Raw:   map[string]interface{}{"slack": map[string]interface{}{"message": "Deployed"}},
+			Error: "slack: channels is required",
+		},
+		"slack unknown key": {
+			Raw:   map[string]interface{}{"slack": map[string]interface{}{"channels": "#ci", "color": "red"}},
+			Error: "slack: unknown key color",
+		},
+		"github status without context": {
+			Raw:   map[string]interface{}{"github_commit_status": map[string]interface{}{}},
+			Error: "github_commit_status: context is required",
+		},
+		"github check string config": {
+			Raw:   map[string]interface{}{"github_check": "monorepo"},
+			Error: "github_check: expected an object with a context, got monorepo",
+		},
+		"invalid item": {
+			Raw:   []interface{}{"slack"},
+			Error: "expected a notification, got [slack]",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := parseNotification(tc.Raw)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestPluginWithNotifySchema(t *testing.T) {
+	param := `[{
+		"monorepo-diff#v1.2.0": {
+			"notify": [
+				"github_check",
+				{"slack": {"channels": ["#ci"], "message": "Monorepo build finished"}},
+				{"github_check": {"context": "monorepo"}}
+			],
+			"watch": [
+				{
+					"path": "service-a/",
+					"config": {
+						"command": "make test",
+						"notify": [
+							"github_commit_status",
+							{"slack": {"channels": "#service-a"}, "if": "build.state == \"failed\""}
+						]
+					}
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	assert.Equal(t, []PluginNotify{
+		{Simple: "github_check"},
+		{Slack: SlackNotification{Channels: []string{"#ci"}, Message: "Monorepo build finished"}},
+		{GithubCheck: GithubStatusNotification{Context: "monorepo"}},
+	}, got.Notify)
+
+	assert.Equal(t, []StepNotify{
+		{Simple: "github_commit_status"},
+		{Slack: SlackNotification{Channels: []string{"#service-a"}}, Condition: "build.state == \"failed\""},
+	}, got.Watch[0].Step.Notify)
+}
+
+func TestPluginWithInvalidNotify(t *testing.T) {
+	testCases := map[string]struct {
+		Config string
+		Error  string
+	}{
+		"plugin": {
+			Config: `{"notify": [{"email": "dev@example.com"}, {"teams": "#ci"}]}`,
+			Error:  "notify[1]: unknown notification type teams",
+		},
+		"unmatched trigger": {
+			Config: `{"unmatched": {"trigger": {"trigger": "a", "notify": ["github"]}}}`,
+			Error:  "unmatched: trigger: notify[0]: unknown notification github",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := initializePlugin(`[{"monorepo-diff#v1.2.0": ` + tc.Config + `}]`)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+tc.Error)
+		})
+	}
+}
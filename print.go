@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Ways the generated pipeline is printed
+const (
+	printFull    = "full"
+	printSummary = "summary"
+	printNone    = "none"
+)
+
+// redacted replaces the env values hidden from the printed pipeline
+const redacted = "[REDACTED]"
+
+// secretLookingName matches the names of env variables likely to hold
+// secrets, whose values are always redacted
+var secretLookingName = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|PASSPHRASE|PRIVATE_KEY|API_KEY|ACCESS_KEY|CREDENTIAL)`)
+
+// validateRedactEnv checks the patterns of redact_env.
+func validateRedactEnv(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("redact_env: invalid regular expression %q", pattern)
+		}
+	}
+
+	return nil
+}
+
+// printPipeline logs the generated pipeline as selected by print_pipeline,
+// with the env values that may be secrets redacted.
+func printPipeline(steps []Step, hooks []Step, plugin Plugin) {
+	switch plugin.PrintPipeline {
+	case printNone:
+		return
+	case printSummary:
+		log.Infof("Generated pipeline with %d steps", len(steps))
+
+		for i, step := range steps {
+			log.Infof("  %s", summaryName(step, i))
+		}
+
+		if len(hooks) > 0 {
+			log.Infof("  and %d hooks", len(hooks))
+		}
+
+		return
+	}
+
+	data, err := marshalPipeline(redactSteps(steps, plugin.RedactEnv), redactSteps(hooks, plugin.RedactEnv), plugin)
+	if err != nil {
+		log.Warnf("Could not print the generated pipeline: %v", err)
+		return
+	}
+
+	log.Info("Generated pipeline:")
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		log.Info(line)
+	}
+}
+
+// summaryName returns the name of the step at index i in the summary,
+// falling back to its first command and then to its position.
+func summaryName(step Step, i int) string {
+	if name := stepName(step); name != "" {
+		return name
+	}
+
+	for _, command := range []interface{}{step.Command, step.Commands} {
+		if list, ok := command.([]interface{}); ok && len(list) > 0 {
+			return fmt.Sprint(list[0])
+		}
+
+		if list, ok := command.([]string); ok && len(list) > 0 {
+			return list[0]
+		}
+
+		if command, ok := isString(command); ok && command != "" {
+			return command
+		}
+	}
+
+	return fmt.Sprintf("step %d", i+1)
+}
+
+// redactSteps returns a copy of steps with the env values matching
+// patterns, or of variables with a secret-looking name, redacted. This
+// covers the env of the steps, the build env of triggers and the env or
+// environment of the plugins of the steps.
+func redactSteps(steps []Step, patterns []string) []Step {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		if re, err := regexp.Compile(pattern); err == nil {
+			compiled = append(compiled, re)
+		}
+	}
+
+	result := make([]Step, len(steps))
+
+	for i, step := range steps {
+		step.Env = redactEnv(step.Env, compiled)
+		step.Build.Env = redactEnv(step.Build.Env, compiled)
+		step.Plugins = redactPlugins(step.Plugins, compiled)
+		result[i] = step
+	}
+
+	return result
+}
+
+func redactEnv(env map[string]string, patterns []*regexp.Regexp) map[string]string {
+	if env == nil {
+		return nil
+	}
+
+	result := make(map[string]string, len(env))
+
+	for key, value := range env {
+		result[key] = redactValue(key, value, patterns)
+	}
+
+	return result
+}
+
+func redactValue(key string, value string, patterns []*regexp.Regexp) string {
+	if value != "" && secretLookingName.MatchString(key) {
+		return redacted
+	}
+
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return redacted
+		}
+	}
+
+	return value
+}
+
+// redactPlugins returns a copy of the plugins of a step with the values of
+// their env or environment options redacted, whether they are maps or
+// lists of KEY=VALUE strings.
+func redactPlugins(plugins interface{}, patterns []*regexp.Regexp) interface{} {
+	switch plugins := plugins.(type) {
+	case []interface{}:
+		result := make([]interface{}, len(plugins))
+		for i, plugin := range plugins {
+			result[i] = redactPlugins(plugin, patterns)
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(plugins))
+		for key, value := range plugins {
+			if key == "env" || key == "environment" {
+				result[key] = redactPluginEnv(value, patterns)
+				continue
+			}
+			result[key] = redactPlugins(value, patterns)
+		}
+		return result
+	}
+
+	return plugins
+}
+
+func redactPluginEnv(env interface{}, patterns []*regexp.Regexp) interface{} {
+	switch env := env.(type) {
+	case []interface{}:
+		result := make([]interface{}, len(env))
+		for i, item := range env {
+			result[i] = item
+
+			if s, ok := isString(item); ok {
+				if key, value, ok := strings.Cut(s, "="); ok {
+					result[i] = key + "=" + redactValue(key, value, patterns)
+				}
+			}
+		}
+		return result
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(env))
+		for key, value := range env {
+			result[key] = value
+
+			if s, ok := isString(value); ok {
+				result[key] = redactValue(key, s, patterns)
+			}
+		}
+		return result
+	}
+
+	return env
+}
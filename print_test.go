@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// captureLog returns the buffer the log is written to for the rest of
+// the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return &buf
+}
+
+func TestRedactSteps(t *testing.T) {
+	steps := []Step{
+		{
+			Command: "make deploy",
+			Env: map[string]string{
+				"GITHUB_TOKEN": "ghp_abc",
+				"DB_PASSWORD":  "hunter2",
+				"EMPTY_SECRET": "",
+				"REGION":       "eu",
+				"WEBHOOK":      "https://hooks.example.com/T0/B0",
+			},
+		},
+		{
+			Trigger: "service-b",
+			Build:   Build{Env: map[string]string{"AWS_ACCESS_KEY_ID": "AKIA123", "SERVICE": "b"}},
+		},
+		{
+			Command: "make test",
+			Plugins: []interface{}{
+				map[string]interface{}{
+					"docker#v5.9.0": map[string]interface{}{
+						"image":       "golang",
+						"environment": []interface{}{"NPM_TOKEN=npm_abc", "CI", "REGION=eu"},
+					},
+				},
+				map[string]interface{}{
+					"other#v1.0.0": map[string]interface{}{
+						"env": map[string]interface{}{"API_KEY": "k3y", "DEBUG": true},
+					},
+				},
+			},
+		},
+	}
+
+	got := redactSteps(steps, []string{`^https://hooks\.example\.com/`})
+
+	assert.Equal(t, map[string]string{
+		"GITHUB_TOKEN": "[REDACTED]",
+		"DB_PASSWORD":  "[REDACTED]",
+		"EMPTY_SECRET": "",
+		"REGION":       "eu",
+		"WEBHOOK":      "[REDACTED]",
+	}, got[0].Env)
+	assert.Equal(t, map[string]string{"AWS_ACCESS_KEY_ID": "[REDACTED]", "SERVICE": "b"}, got[1].Build.Env)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"docker#v5.9.0": map[string]interface{}{
+				"image":       "golang",
+				"environment": []interface{}{"NPM_TOKEN=[REDACTED]", "CI", "REGION=eu"},
+			},
+		},
+		map[string]interface{}{
+			"other#v1.0.0": map[string]interface{}{
+				"env": map[string]interface{}{"API_KEY": "[REDACTED]", "DEBUG": true},
+			},
+		},
+	}, got[2].Plugins)
+
+	assert.Equal(t, "ghp_abc", steps[0].Env["GITHUB_TOKEN"])
+	assert.Equal(t, "AKIA123", steps[1].Build.Env["AWS_ACCESS_KEY_ID"])
+	other := steps[2].Plugins.([]interface{})[1].(map[string]interface{})["other#v1.0.0"].(map[string]interface{})
+	assert.Equal(t, "k3y", other["env"].(map[string]interface{})["API_KEY"])
+}
+
+func TestPrintPipeline(t *testing.T) {
+	steps := []Step{
+		{Label: "Deploy", Command: "make deploy", Env: map[string]string{"DEPLOY_TOKEN": "t0k3n"}},
+		{Trigger: "service-b"},
+		{Commands: []interface{}{"make lint", "make test"}},
+		{Plugins: []interface{}{"docker#v5.9.0"}},
+	}
+	hooks := []Step{{Command: "echo done"}}
+
+	testCases := map[string]struct {
+		Mode     string
+		Contains []string
+		Excludes []string
+	}{
+		"full by default": {
+			Mode:     "",
+			Contains: []string{"Generated pipeline:", "command: make deploy", "DEPLOY_TOKEN: '[REDACTED]'", "command: echo done"},
+			Excludes: []string{"t0k3n"},
+		},
+		"summary": {
+			Mode:     printSummary,
+			Excludes: []string{"t0k3n", "DEPLOY_TOKEN"},
+			Contains: []string{
+				"Generated pipeline with 4 steps", "  Deploy", "  service-b", "  make lint", "  step 4", "and 1 hooks",
+			},
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			buf := captureLog(t)
+
+			printPipeline(steps, hooks, Plugin{PrintPipeline: tc.Mode})
+
+			for _, s := range tc.Contains {
+				assert.Contains(t, buf.String(), s)
+			}
+
+			for _, s := range tc.Excludes {
+				assert.NotContains(t, buf.String(), s)
+			}
+		})
+	}
+}
+
+func TestPrintPipelineNone(t *testing.T) {
+	buf := captureLog(t)
+
+	printPipeline([]Step{{Command: "make"}}, nil, Plugin{PrintPipeline: printNone})
+
+	assert.Empty(t, buf.String())
+}
+
+func TestGeneratePipelineDoesNotRedactTheUploadedPipeline(t *testing.T) {
+	steps := []Step{{Command: "make deploy", Env: map[string]string{"DEPLOY_TOKEN": "t0k3n"}}}
+
+	pipeline, _, err := generatePipeline(steps, Plugin{})
+	require.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	got, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+	assert.Contains(t, string(got), "DEPLOY_TOKEN: t0k3n")
+}
+
+func TestPluginPrintOptions(t *testing.T) {
+	got, err := initializePlugin(`[{"monorepo-diff#v1.2.0": {"print_pipeline": "summary", "redact_env": ["^ghp_"]}}]`)
+	require.NoError(t, err)
+	assert.Equal(t, printSummary, got.PrintPipeline)
+	assert.Equal(t, []string{"^ghp_"}, got.RedactEnv)
+
+	_, err = initializePlugin(`[{"monorepo-diff#v1.2.0": {"print_pipeline": "yes"}}]`)
+	assert.EqualError(t, err, "failed to parse plugin configuration: print_pipeline: expected full, summary or none, got yes")
+
+	_, err = initializePlugin(`[{"monorepo-diff#v1.2.0": {"redact_env": ["("]}}]`)
+	assert.EqualError(t, err, `failed to parse plugin configuration: redact_env: invalid regular expression "("`)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Providers of the secrets referenced by env values
+const (
+	secretProviderBuildkite = "buildkite"
+	secretProviderFile      = "file"
+)
+
+// secretPrefix marks the env values referencing a secret
+const secretPrefix = "$secret:"
+
+// errFileSecret rejects step secrets of the file provider, whose values
+// would end up in the uploaded pipeline
+var errFileSecret = fmt.Errorf("secrets of the %s provider are only supported in upload_env", secretProviderFile)
+
+// secretReference matches env values referencing a secret, with the $
+// escaped or not.
+var secretReference = regexp.MustCompile(`^\$\$?secret:(.+)$`)
+
+// SecretsConfig selects how the secrets referenced by env values are
+// passed to the steps
+type SecretsConfig struct {
+	Provider string
+	File     string
+}
+
+// SecretProvider resolves the value of a secret
+type SecretProvider interface {
+	Secret(name string) (string, error)
+}
+
+// fileSecretProvider reads secrets from a file of NAME=VALUE lines
+type fileSecretProvider struct {
+	file    string
+	secrets map[string]string
+}
+
+func (c SecretsConfig) validate() error {
+	switch c.Provider {
+	case "", secretProviderBuildkite:
+		if c.File != "" {
+			return fmt.Errorf("secrets: file is only valid with the %s provider", secretProviderFile)
+		}
+	case secretProviderFile:
+		if c.File == "" {
+			return fmt.Errorf("secrets: file is required with the %s provider", secretProviderFile)
+		}
+	default:
+		return fmt.Errorf(
+			"secrets: provider: expected %s or %s, got %s", secretProviderBuildkite, secretProviderFile, c.Provider,
+		)
+	}
+
+	return nil
+}
+
+// provider returns the provider resolving the secrets, or nil when the
+// steps declare them for Buildkite to resolve.
+func (c SecretsConfig) provider() (SecretProvider, error) {
+	if c.Provider != secretProviderFile {
+		return nil, nil
+	}
+
+	return newFileSecretProvider(c.File)
+}
+
+func newFileSecretProvider(file string) (*fileSecretProvider, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("secrets: %v", err)
+	}
+
+	secrets := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		name, value, ok := strings.Cut(text, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("secrets: %s:%d: expected NAME=VALUE", file, line)
+		}
+
+		secrets[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+
+	return &fileSecretProvider{file: file, secrets: secrets}, nil
+}
+
+func (p *fileSecretProvider) Secret(name string) (string, error) {
+	value, ok := p.secrets[name]
+	if !ok {
+		return "", fmt.Errorf("secret %s is not in %s", name, p.file)
+	}
+
+	return value, nil
+}
+
+// secretName returns the name of the secret an env value references.
+func secretName(value string) (string, bool) {
+	match := secretReference.FindStringSubmatch(value)
+	if match == nil {
+		return "", false
+	}
+
+	return match[1], true
+}
+
+// applySecrets replaces the secret references of the env of step,
+// which command steps declare for Buildkite to resolve when they run.
+// The values of the file provider are only passed to the upload process,
+// so they cannot be referenced by steps.
+func applySecrets(step *Step, provider SecretProvider) error {
+	for _, key := range sortedKeys(step.Env) {
+		name, ok := secretName(step.Env[key])
+		if !ok {
+			continue
+		}
+
+		if provider != nil {
+			return fmt.Errorf("env: %s: %v", key, errFileSecret)
+		}
+
+		if step.Command == nil && step.Commands == nil {
+			return fmt.Errorf("env: %s: secrets are only supported on command steps", key)
+		}
+
+		if step.Secrets == nil {
+			step.Secrets = map[string]string{}
+		}
+
+		step.Secrets[key] = name
+		delete(step.Env, key)
+	}
+
+	for _, key := range sortedKeys(step.Build.Env) {
+		if _, ok := secretName(step.Build.Env[key]); ok {
+			return fmt.Errorf("build: env: %s: secrets are not supported in the build env of triggers", key)
+		}
+	}
+
+	return nil
+}
+
+// resolveUploadSecrets replaces the secret references of the upload env
+// by their values, which are only passed to the upload process.
+func resolveUploadSecrets(uploadEnv map[string]string, provider SecretProvider) error {
+	for _, key := range sortedKeys(uploadEnv) {
+		name, ok := secretName(uploadEnv[key])
+		if !ok {
+			continue
+		}
+
+		if provider == nil {
+			return fmt.Errorf("upload_env: %s: secrets need the %s provider", key, secretProviderFile)
+		}
+
+		value, err := provider.Secret(name)
+		if err != nil {
+			return fmt.Errorf("upload_env: %s: %v", key, err)
+		}
+
+		uploadEnv[key] = value
+	}
+
+	return nil
+}
+
+// setupSecrets applies the secret references of the env of the steps of
+// plugin, and resolves those of its upload env.
+func (plugin *Plugin) setupSecrets(labels []string) error {
+	provider, err := plugin.Secrets.provider()
+	if err != nil {
+		return err
+	}
+
+	if err := resolveUploadSecrets(plugin.UploadEnv, provider); err != nil {
+		return err
+	}
+
+	for i := range plugin.Watch {
+		if err := applySecrets(&plugin.Watch[i].Step, provider); err != nil {
+			return fmt.Errorf("%s: %v", labels[i], err)
+		}
+	}
+
+	if plugin.Unmatched.Step != nil {
+		if err := applySecrets(plugin.Unmatched.Step, provider); err != nil {
+			return fmt.Errorf("unmatched: trigger: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSecrets(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "secrets.env")
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+
+	return file
+}
+
+func TestFileSecretProvider(t *testing.T) {
+	file := writeSecrets(t, `
+# deploy secrets
+DEPLOY_TOKEN=abc=123
+ db/password = hunter2
+`)
+
+	provider, err := newFileSecretProvider(file)
+	require.NoError(t, err)
+
+	value, err := provider.Secret("DEPLOY_TOKEN")
+	assert.NoError(t, err)
+	assert.Equal(t, "abc=123", value)
+
+	value, err = provider.Secret("db/password")
+	assert.NoError(t, err)
+	assert.Equal(t, "hunter2", value)
+
+	_, err = provider.Secret("MISSING")
+	assert.EqualError(t, err, "secret MISSING is not in "+file)
+}
+
+func TestFileSecretProviderErrors(t *testing.T) {
+	file := writeSecrets(t, "A=1\nnot a secret\n")
+
+	_, err := newFileSecretProvider(file)
+	assert.EqualError(t, err, "secrets: "+file+":2: expected NAME=VALUE")
+
+	_, err = newFileSecretProvider(filepath.Join(t.TempDir(), "missing.env"))
+	assert.ErrorContains(t, err, "secrets: open ")
+}
+
+func TestSecretName(t *testing.T) {
+	testCases := map[string]struct {
+		Value    string
+		Expected string
+		Ok       bool
+	}{
+		"reference":         {Value: "$secret:DEPLOY_TOKEN", Expected: "DEPLOY_TOKEN", Ok: true},
+		"escaped reference": {Value: "$$secret:db/password", Expected: "db/password", Ok: true},
+		"plain value":       {Value: "secret:DEPLOY_TOKEN"},
+		"embedded":          {Value: "token $secret:DEPLOY_TOKEN"},
+		"no name":           {Value: "$secret:"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, ok := secretName(tc.Value)
+			assert.Equal(t, tc.Ok, ok)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestPluginWithBuildkiteSecrets(t *testing.T) {
+	param := `[{
+		"monorepo-diff#v1.2.0": {
+			"env": {"DEPLOY_TOKEN": {"secret": "deploy-token"}, "REGION": "eu"},
+			"env_target": "command",
+			"watch": [
+				{
+					"path": "service-a/",
+					"config": {
+						"command": "make deploy",
+						"env": ["DB_PASSWORD=$secret:db/password"]
+					}
+				},
+				{
+					"path": "service-b/",
+					"config": {"trigger": "service-b"}
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"REGION": "eu"}, got.Watch[0].Step.Env)
+	assert.Equal(t, map[string]string{
+		"DEPLOY_TOKEN": "deploy-token",
+		"DB_PASSWORD":  "db/password",
+	}, got.Watch[0].Step.Secrets)
+	assert.Nil(t, got.UploadEnv)
+
+	pipeline, _, err := generatePipeline([]Step{got.Watch[0].Step}, Plugin{})
+	require.NoError(t, err)
+	defer os.Remove(pipeline.Name())
+
+	generated, err := os.ReadFile(pipeline.Name())
+	require.NoError(t, err)
+
+	assert.Equal(t, `steps:
+- command: make deploy
+  env:
+    REGION: eu
+  secrets:
+    DB_PASSWORD: db/password
+    DEPLOY_TOKEN: deploy-token
+`, string(generated))
+}
+
+func TestPluginWithFileSecrets(t *testing.T) {
+	file := writeSecrets(t, "DEBUG_TOKEN=d3bug\n")
+
+	got, err := initializePlugin(`[{
+		"monorepo-diff#v1.2.0": {
+			"secrets": {"provider": "file", "file": "` + file + `"},
+			"upload_env": ["BUILDKITE_AGENT_DEBUG_TOKEN=$secret:DEBUG_TOKEN"]
+		}
+	}]`)
+	require.NoError(t, err)
+	assert.False(t, got.SkipUpload)
+	assert.Equal(t, map[string]string{"BUILDKITE_AGENT_DEBUG_TOKEN": "d3bug"}, got.UploadEnv)
+}
+
+func TestPluginWithInvalidSecrets(t *testing.T) {
+	file := writeSecrets(t, "deploy-token=t0k3n\n")
+
+	testCases := map[string]struct {
+		Config string
+		Error  string
+	}{
+		"unknown provider": {
+			Config: `{"secrets": {"provider": "vault"}}`,
+			Error:  "secrets: provider: expected buildkite or file, got vault",
+		},
+		"file without provider": {
+			Config: `{"secrets": {"file": "secrets.env"}}`,
+			Error:  "secrets: file is only valid with the file provider",
+		},
+		"provider without file": {
+			Config: `{"secrets": {"provider": "file"}}`,
+			Error:  "secrets: file is required with the file provider",
+		},
+		"unknown secret": {
+			Config: `{
+				"secrets": {"provider": "file", "file": "` + file + `"},
+				"upload_env": {"TOKEN": {"secret": "other"}}
+			}`,
+			Error: "upload_env: TOKEN: secret other is not in " + file,
+		},
+		"file secret in a step": {
+			Config: `{
+				"secrets": {"provider": "file", "file": "` + file + `"},
+				"upload": false,
+				"watch": [{"path": "a/", "config": {"command": "make", "env": {"TOKEN": {"secret": "deploy-token"}}}}]
+			}`,
+			Error: "watch[0]: env: TOKEN: secrets of the file provider are only supported in upload_env",
+		},
+		"file secret in the plugin env": {
+			Config: `{
+				"secrets": {"provider": "file", "file": "` + file + `"},
+				"env": {"TOKEN": {"secret": "deploy-token"}},
+				"watch": [{"path": "a/", "config": {"command": "make"}}]
+			}`,
+			Error: "watch[0]: env: TOKEN: secrets of the file provider are only supported in upload_env",
+		},
+		"invalid reference": {
+			Config: `{"env": {"TOKEN": {"secret": "a", "field": "b"}}}`,
+			Error:  "env: TOKEN: expected a secret reference like {secret: NAME}, got map[field:b secret:a]",
+		},
+		"trigger build env": {
+			Config: `{"watch": [{"path": "a/", "config": {"trigger": "a", "build": {"env": {"TOKEN": {"secret": "a"}}}}}]}`,
+			Error:  "watch[0]: build: env: TOKEN: secrets are not supported in the build env of triggers",
+		},
+		"group step": {
+			Config: `{"watch": [{"path": "a/", "config": {"group": "a", "env": {"TOKEN": {"secret": "a"}}}}]}`,
+			Error:  "watch[0]: env: TOKEN: secrets are only supported on command steps",
+		},
+		"upload env": {
+			Config: `{"upload_env": {"TOKEN": {"secret": "a"}}}`,
+			Error:  "upload_env: TOKEN: secrets need the file provider",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := initializePlugin(`[{"monorepo-diff#v1.2.0": ` + tc.Config + `}]`)
+			assert.EqualError(t, err, "failed to parse plugin configuration: "+tc.Error)
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+)
+
+// SigningConfig is the configuration for Buildkite signed pipelines. The
+// pipeline is signed by buildkite-agent pipeline upload.
+// https://buildkite.com/docs/agent/v3/signed-pipelines
+type SigningConfig struct {
+	JWKSFile  string `json:"jwks_file"`
+	JWKSKeyID string `json:"jwks_key_id"`
+}
+
+func (c SigningConfig) validate() error {
+	if c.JWKSFile == "" && c.JWKSKeyID != "" {
+		return errors.New("signing: jwks_file is required")
+	}
+
+	return nil
+}
+
+// uploadArgs returns the arguments that make the agent sign the pipeline.
+func (c SigningConfig) uploadArgs() []string {
+	if c.JWKSFile == "" {
+		return []string{}
+	}
+
+	args := []string{"--jwks-file", c.JWKSFile}
+	if c.JWKSKeyID != "" {
+		args = append(args, "--jwks-key-id", c.JWKSKeyID)
+	}
+
+	return args
+}
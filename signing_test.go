@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningUploadArgs(t *testing.T) {
+	assert.Equal(t, []string{}, SigningConfig{}.uploadArgs())
+	assert.Equal(t, []string{"--jwks-file", "jwks.json"}, SigningConfig{JWKSFile: "jwks.json"}.uploadArgs())
+	assert.Equal(t,
+		[]string{"--jwks-file", "jwks.json", "--jwks-key-id", "my-key"},
+		SigningConfig{JWKSFile: "jwks.json", JWKSKeyID: "my-key"}.uploadArgs(),
+	)
+}
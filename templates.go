@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// appendedKeys are the keys whose lists are appended when a step config
+// extends a template, rather than replaced
+var appendedKeys = map[string]bool{
+	"env":     true,
+	"notify":  true,
+	"plugins": true,
+}
+
+// resolveTemplates replaces the `extends` fields of the step configs of
+// the watch entries in the raw plugin configuration by the templates
+// they name.
+func resolveTemplates(data []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	templates, err := parseTemplates(raw["templates"])
+	if err != nil {
+		return nil, err
+	}
+
+	watch, ok := raw["watch"].([]interface{})
+	if !ok {
+		return data, nil
+	}
+
+	for i, entry := range watch {
+		if err := extendEntry(entry, templates); err != nil {
+			return nil, fmt.Errorf("watch[%d]: %v", i, err)
+		}
+	}
+
+	return json.Marshal(raw)
+}
+
+func parseTemplates(raw interface{}) (map[string]interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	templates, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("templates: expected a map of step configs")
+	}
+
+	for name, template := range templates {
+		if _, ok := template.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("templates: %s: expected a step config", name)
+		}
+	}
+
+	return templates, nil
+}
+
+// extendEntry resolves the templates of the `config` and `default`
+// step configs of a raw watch entry, in place.
+func extendEntry(entry interface{}, templates map[string]interface{}) error {
+	w, ok := entry.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	if config, ok := w["config"].(map[string]interface{}); ok {
+		resolved, err := extend(config, templates, nil)
+		if err != nil {
+			return fmt.Errorf("config: %v", err)
+		}
+		w["config"] = resolved
+	}
+
+	switch d := w["default"].(type) {
+	case map[string]interface{}:
+		resolved, err := extendDefault(d, templates)
+		if err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+		w["default"] = resolved
+	case []interface{}:
+		for i, item := range d {
+			config, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			resolved, err := extendDefault(config, templates)
+			if err != nil {
+				return fmt.Errorf("default[%d]: %v", i, err)
+			}
+			d[i] = resolved
+		}
+	}
+
+	return nil
+}
+
+// extendDefault resolves the templates of a default step config,
+// which may be nested under a `config` key.
+func extendDefault(config map[string]interface{}, templates map[string]interface{}) (map[string]interface{}, error) {
+	nested, ok := config["config"].(map[string]interface{})
+	if !ok {
+		return extend(config, templates, nil)
+	}
+
+	resolved, err := extend(nested, templates, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeConfig(config, map[string]interface{}{"config": resolved}), nil
+}
+
+// extend merges config over the templates it extends, themselves
+// resolved recursively. seen holds the templates being resolved.
+func extend(config map[string]interface{}, templates map[string]interface{}, seen []string) (map[string]interface{}, error) {
+	names, err := stringList(config["extends"])
+	if err != nil {
+		return nil, fmt.Errorf("extends: %v", err)
+	}
+
+	if len(names) == 0 {
+		return config, nil
+	}
+
+	result := map[string]interface{}{}
+
+	for _, name := range names {
+		for _, s := range seen {
+			if s == name {
+				return nil, fmt.Errorf("extends: template %s extends itself", name)
+			}
+		}
+
+		template, ok := templates[name]
+		if !ok {
+			return nil, fmt.Errorf("extends: unknown template %s", name)
+		}
+
+		resolved, err := extend(template.(map[string]interface{}), templates, append(seen, name))
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+
+		result = mergeConfig(result, resolved)
+	}
+
+	own := map[string]interface{}{}
+	for key, value := range config {
+		if key != "extends" {
+			own[key] = value
+		}
+	}
+
+	return mergeConfig(result, own), nil
+}
+
+// mergeConfig returns a deep merge of override over base: maps are
+// merged, the lists of appendedKeys are appended to those of base,
+// and any other value replaces that of base.
+func mergeConfig(base map[string]interface{}, override map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(base)+len(override))
+
+	for key, value := range base {
+		result[key] = value
+	}
+
+	for key, value := range override {
+		switch value := value.(type) {
+		case map[string]interface{}:
+			if current, ok := result[key].(map[string]interface{}); ok {
+				result[key] = mergeConfig(current, value)
+				continue
+			}
+		case []interface{}:
+			if current, ok := result[key].([]interface{}); ok && appendedKeys[key] {
+				merged := make([]interface{}, 0, len(current)+len(value))
+				result[key] = append(append(merged, current...), value...)
+				continue
+			}
+		}
+
+		result[key] = value
+	}
+
+	return result
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeConfig(t *testing.T) {
+	base := map[string]interface{}{
+		"agents":    map[string]interface{}{"queue": "linux", "os": "ubuntu"},
+		"env":       []interface{}{"GOFLAGS=-mod=mod"},
+		"artifacts": []interface{}{"coverage.out"},
+		"plugins":   []interface{}{map[string]interface{}{"docker#v5": nil}},
+		"build":     map[string]interface{}{"env": []interface{}{"A=1"}},
+		"retry":     map[string]interface{}{"automatic": true},
+	}
+
+	override := map[string]interface{}{
+		"agents":    map[string]interface{}{"queue": "arm"},
+		"env":       []interface{}{"SERVICE=a"},
+		"artifacts": []interface{}{"report.xml"},
+		"plugins":   []interface{}{map[string]interface{}{"cache#v1": nil}},
+		"build":     map[string]interface{}{"env": []interface{}{"B=2"}},
+		"retry":     false,
+		"command":   "make test",
+	}
+
+	got := mergeConfig(base, override)
+
+	assert.Equal(t, map[string]interface{}{
+		"agents":    map[string]interface{}{"queue": "arm", "os": "ubuntu"},
+		"env":       []interface{}{"GOFLAGS=-mod=mod", "SERVICE=a"},
+		"artifacts": []interface{}{"report.xml"},
+		"plugins": []interface{}{
+			map[string]interface{}{"docker#v5": nil},
+			map[string]interface{}{"cache#v1": nil},
+		},
+		"build":   map[string]interface{}{"env": []interface{}{"A=1", "B=2"}},
+		"retry":   false,
+		"command": "make test",
+	}, got)
+
+	assert.Equal(t, map[string]interface{}{"queue": "linux", "os": "ubuntu"}, base["agents"])
+	assert.Equal(t, []interface{}{"GOFLAGS=-mod=mod"}, base["env"])
+}
+
+func TestExtend(t *testing.T) {
+	templates := map[string]interface{}{
+		"go": map[string]interface{}{
+			"agents": map[string]interface{}{"queue": "go"},
+			"env":    []interface{}{"GOFLAGS=-mod=mod"},
+		},
+		"go-service": map[string]interface{}{
+			"extends": "go",
+			"retry":   map[string]interface{}{"automatic": true},
+		},
+		"notify": map[string]interface{}{
+			"notify": []interface{}{map[string]interface{}{"slack": "#ci"}},
+		},
+		"loop-a":  map[string]interface{}{"extends": "loop-b"},
+		"loop-b":  map[string]interface{}{"extends": "loop-a"},
+		"missing": map[string]interface{}{"extends": "nope"},
+	}
+
+	testCases := map[string]struct {
+		Config   map[string]interface{}
+		Expected map[string]interface{}
+		Error    string
+	}{
+		"no extends": {
+			Config:   map[string]interface{}{"command": "make"},
+			Expected: map[string]interface{}{"command": "make"},
+		},
+		"nested templates": {
+			Config: map[string]interface{}{"extends": "go-service", "command": "make", "env": []interface{}{"SERVICE=a"}},
+			Expected: map[string]interface{}{
+				"agents":  map[string]interface{}{"queue": "go"},
+				"env":     []interface{}{"GOFLAGS=-mod=mod", "SERVICE=a"},
+				"retry":   map[string]interface{}{"automatic": true},
+				"command": "make",
+			},
+		},
+		"several templates": {
+			Config: map[string]interface{}{"extends": []interface{}{"go", "notify"}, "command": "make"},
+			Expected: map[string]interface{}{
+				"agents":  map[string]interface{}{"queue": "go"},
+				"env":     []interface{}{"GOFLAGS=-mod=mod"},
+				"notify":  []interface{}{map[string]interface{}{"slack": "#ci"}},
+				"command": "make",
+			},
+		},
+		"unknown template": {
+			Config: map[string]interface{}{"extends": "python"},
+			Error:  "extends: unknown template python",
+		},
+		"unknown nested template": {
+			Config: map[string]interface{}{"extends": "missing"},
+			Error:  "template missing: extends: unknown template nope",
+		},
+		"cycle": {
+			Config: map[string]interface{}{"extends": "loop-a"},
+			Error:  "template loop-a: template loop-b: extends: template loop-a extends itself",
+		},
+		"invalid extends": {
+			Config: map[string]interface{}{"extends": 1},
+			Error:  "extends: expected a string or a list of strings, got 1",
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			got, err := extend(tc.Config, templates, nil)
+
+			if tc.Error != "" {
+				assert.EqualError(t, err, tc.Error)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestPluginWithTemplates(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"env": ["env1=env-1"],
+			"templates": {
+				"go": {
+					"agents": {"queue": "go"},
+					"env": ["CGO_ENABLED=0"],
+					"retry": {"automatic": [{"exit_status": -1, "limit": 2}]},
+					"plugins": [{"docker#v5.9.0": {"image": "golang:1.19"}}],
+					"notify": [{"slack": "#ci"}]
+				}
+			},
+			"watch": [
+				{
+					"path": "service-a/",
+					"config": {
+						"extends": "go",
+						"command": "make test",
+						"env": ["SERVICE=a"]
+					}
+				},
+				{
+					"default": [
+						{"extends": "go", "command": "make smoke-test"}
+					]
+				}
+			]
+		}
+	}]`
+
+	got, err := initializePlugin(param)
+	require.NoError(t, err)
+
+	expected := Step{
+		Command: "make test",
+		Agents:  Agent{"queue": "go"},
+		Env: map[string]string{
+			"CGO_ENABLED": "0",
+			"SERVICE":     "a",
+			"env1":        "env-1",
+		},
+		Retry: map[string]interface{}{
+			"automatic": []interface{}{map[string]interface{}{"exit_status": float64(-1), "limit": float64(2)}},
+		},
+		Plugins: []interface{}{
+			map[string]interface{}{"docker#v5.9.0": map[string]interface{}{"image": "golang:1.19"}},
+		},
+		Notify: []StepNotify{{Slack: "#ci"}},
+	}
+
+	assert.Equal(t, expected, got.Watch[0].Step)
+
+	expected.Command = "make smoke-test"
+	expected.Env = map[string]string{"CGO_ENABLED": "0", "env1": "env-1"}
+	assert.Equal(t, expected, got.Watch[1].Step)
+}
+
+func TestPluginWithTemplatesInWatchFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "watch.yml")
+	require.NoError(t, os.WriteFile(file, []byte(`
+- path: service-a/
+  config:
+    extends: go
+    command: make test
+- path: service-b/
+  config:
+    extends: python
+`), 0o644))
+
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"templates": {"go": {"agents": {"queue": "go"}}},
+			"watch_file": "` + file + `"
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: "+file+":6: watch[1]: config: extends: unknown template python")
+}
+
+func TestPluginWithInvalidTemplates(t *testing.T) {
+	param := `[{
+		"github.com/buildkite-plugins/monorepo-diff-buildkite-plugin#commit": {
+			"templates": {"go": "make"},
+			"watch": [{"path": "service-a/", "config": {"extends": "go"}}]
+		}
+	}]`
+
+	_, err := initializePlugin(param)
+	assert.EqualError(t, err, "failed to parse plugin configuration: templates: go: expected a step config")
+}
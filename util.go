@@ -2,15 +2,53 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
+	"syscall"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// commandRunner runs an external command with env added to the environment
+// of the current process, and returns its stdout. The command is killed
+// when ctx is done.
+type commandRunner func(ctx context.Context, command string, args []string, env map[string]string) (string, error)
+
+// runCommand is the commandRunner used by the plugin, replaced in tests
+// to fake external commands.
+var runCommand commandRunner = runExternalCommand
+
+// interrupted is done when the plugin is asked to stop, for example when
+// the job is cancelled. The commands run by the plugin are derived from it,
+// so that they are killed with their process group instead of being left
+// running.
+var interrupted = context.Background()
+
 func executeCommand(command string, args []string) (string, error) {
+	return runCommand(interrupted, command, args, nil)
+}
+
+func runExternalCommand(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", commandError(command, err, "")
+	}
+
 	cmd := exec.Command(command, args...)
+	// Run the command in its own process group, so that the processes it
+	// starts are killed with it on timeout or interruption.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if len(env) > 0 {
+		cmd.Env = os.Environ()
+		for key, value := range env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+	}
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
@@ -18,18 +56,96 @@ func executeCommand(command string, args []string) (string, error) {
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
 
-	if err := cmd.Run(); err != nil {
-		log.Debugf(
-			"\ncommand = '%s', \nargs = '%s', \nerror = '%s'",
-			command, args, stderr.String(),
-		)
-
+	if err := cmd.Start(); err != nil {
 		return "", fmt.Errorf("command `%s` failed: %v", command, err)
 	}
 
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Debugf("\ncommand = '%s', \nargs = '%s'", command, args)
+
+			return "", commandError(command, err, stderr.String())
+		}
+	case <-ctx.Done():
+		// Don't wait for the output to be closed, as processes
+		// started by the command may still hold it open.
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+		return "", commandError(command, ctx.Err(), "")
+	}
+
 	return out.String(), nil
 }
 
+func commandError(command string, err error, stderr string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("command `%s` timed out", command)
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("command `%s` was interrupted", command)
+	}
+
+	if stderr = strings.TrimSpace(stderr); stderr != "" {
+		return fmt.Errorf("command `%s` failed: %v: %s", command, err, stderr)
+	}
+
+	return fmt.Errorf("command `%s` failed: %v", command, err)
+}
+
+// contextWithTimeout returns a context that is done after timeout, or
+// never if timeout is zero, unless the plugin is interrupted first.
+func contextWithTimeout(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(interrupted)
+	}
+
+	return context.WithTimeout(interrupted, timeout)
+}
+
+// noRetry wraps an error that retry returns without trying again.
+type noRetry struct {
+	err error
+}
+
+func (e noRetry) Error() string {
+	return e.err.Error()
+}
+
+// retry calls f until it succeeds, at most attempts times, waiting backoff
+// before the first retry and twice as long before each of the next ones.
+func retry(attempts int, backoff time.Duration, f func() error) error {
+	var err error
+
+	for i := 1; i <= attempts; i++ {
+		if err = f(); err == nil {
+			return nil
+		}
+
+		var stop noRetry
+		if errors.As(err, &stop) {
+			return stop.err
+		}
+
+		if i < attempts {
+			log.Warnf("attempt %d of %d failed, retrying in %v: %v", i, attempts, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+
+	return err
+}
+
+// shellQuote quotes value for use as a single word in a shell command.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
 func env(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRunCommand replaces the command runner for the duration of the test.
+func fakeRunCommand(t *testing.T, runner commandRunner) {
+	original := runCommand
+	t.Cleanup(func() { runCommand = original })
+	runCommand = runner
+}
+
+func TestExecuteCommand(t *testing.T) {
+	got, err := executeCommand("echo", []string{"hello"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", got)
+}
+
+func TestRunCommandWithEnv(t *testing.T) {
+	got, err := runExternalCommand(context.Background(), "sh", []string{"-c", "echo $GREETING"}, map[string]string{"GREETING": "hi"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "hi\n", got)
+}
+
+func TestExecuteCommandSurfacesStderr(t *testing.T) {
+	_, err := executeCommand("sh", []string{"-c", "echo oops >&2; exit 3"})
+
+	assert.EqualError(t, err, "command `sh` failed: exit status 3: oops")
+}
+
+func TestRunCommandTimesOut(t *testing.T) {
+	ctx, cancel := contextWithTimeout(100 * time.Millisecond)
+	defer cancel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+
+	start := time.Now()
+	_, err := runExternalCommand(ctx, "sh", []string{"-c", "sleep 10 & echo $! > " + pidFile + "; sleep 10"}, nil)
+
+	assert.EqualError(t, err, "command `sh` timed out")
+	assert.Less(t, time.Since(start), 5*time.Second)
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+
+	// The background sleep is killed with the command
+	assert.Eventually(t, func() bool {
+		return !processRunning(pid)
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestRunCommandIsInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := runExternalCommand(ctx, "sh", []string{"-c", "sleep 10 & echo $! > " + pidFile + "; sleep 10"}, nil)
+	assert.EqualError(t, err, "command `sh` was interrupted")
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		return !processRunning(pid)
+	}, 2*time.Second, 10*time.Millisecond)
+
+	_, err = runExternalCommand(ctx, "true", nil, nil)
+	assert.EqualError(t, err, "command `true` was interrupted")
+}
+
+// processRunning tells if the process pid is alive, and not a zombie
+// waiting to be reaped.
+func processRunning(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	return err != nil || !strings.Contains(string(stat), ") Z ")
+}
+
+func TestRetryStopsOnNoRetry(t *testing.T) {
+	calls := 0
+	err := retry(3, time.Millisecond, func() error {
+		calls++
+		return noRetry{errors.New("timed out")}
+	})
+
+	assert.EqualError(t, err, "timed out")
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := retry(3, time.Millisecond, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	calls := 0
+	err := retry(2, time.Millisecond, func() error {
+		calls++
+		return errors.New("permanent")
+	})
+
+	assert.EqualError(t, err, "permanent")
+	assert.Equal(t, 2, calls)
+}
+
+func TestShellQuote(t *testing.T) {
+	assert.Equal(t, "'main'", shellQuote("main"))
+	assert.Equal(t, `'it'\''s'`, shellQuote("it's"))
+}
+
+func TestFakeRunCommand(t *testing.T) {
+	fakeRunCommand(t, func(ctx context.Context, command string, args []string, env map[string]string) (string, error) {
+		return command + " faked", nil
+	})
+
+	got, err := executeCommand("anything", nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "anything faked", got)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadWatchFile reads watch entries from a YAML or JSON file, holding
+// either a list of entries or a map with a `watch` list, and resolves
+// their templates. It returns the entries along with labels naming them
+// by file and line in errors.
+func loadWatchFile(file string, templates map[string]interface{}) ([]WatchConfig, []string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("watch_file: %v", err)
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("watch_file: %s: %v", file, err)
+	}
+
+	if len(doc.Content) == 0 {
+		return nil, nil, nil
+	}
+
+	list := doc.Content[0]
+	if list.Kind == yaml.MappingNode {
+		list = mappingValue(list, "watch")
+		if list == nil {
+			return nil, nil, fmt.Errorf("watch_file: %s:%d: expected a watch key", file, doc.Content[0].Line)
+		}
+	}
+
+	if list.Kind != yaml.SequenceNode {
+		return nil, nil, fmt.Errorf("watch_file: %s:%d: expected a list of watch entries", file, list.Line)
+	}
+
+	watch := make([]WatchConfig, len(list.Content))
+	labels := make([]string, len(list.Content))
+
+	for i, item := range list.Content {
+		labels[i] = fmt.Sprintf("%s:%d: watch[%d]", file, item.Line, i)
+
+		var raw interface{}
+		if err := item.Decode(&raw); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", labels[i], err)
+		}
+
+		if err := extendEntry(raw, templates); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", labels[i], err)
+		}
+
+		b, err := json.Marshal(raw)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", labels[i], err)
+		}
+
+		if err := json.Unmarshal(b, &watch[i]); err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", labels[i], err)
+		}
+	}
+
+	return watch, labels, nil
+}
+
+// mappingValue returns the value of key in a YAML mapping node.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}